@@ -3,26 +3,41 @@ package comms
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
 	"go_fast_copy/networking"
 	"go_fast_copy/networking/opcode"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/ipv4"
 )
 
 type Client struct {
-	socket net.Conn
-	crypto *networking.Crypto
+	socket       net.Conn
+	crypto       *networking.Crypto
+	capabilities networking.Capabilities
+	retransmit   bool
+	window       map[uint32][]byte // Recently sent chunks by sequence number
+	windowOrder  []uint32
+	retransmits  map[uint32]int
+	unsent       bool // Chunk server asked for could not be sent again
+	nacks        chan uint32
+	responses    chan *networking.Packet
+	limiter      *networking.RateLimiter // Limits bandwidth of file data sent if set
+	sent         atomic.Uint64           // Original size of data of file sent so far
+	exit         func(code int)          // Ends client once connection is lost
 }
 
 // Connect opens TCP connection to target host address
@@ -106,12 +121,56 @@ func (c *Client) Authenticate(key string, nonce []byte) (*networking.Crypto, err
 		if resp.Flags != 1 {
 			return nil, errors.New("authentication failed")
 		}
+		if len(resp.Payload) > 0 {
+			networking.DecodePayload(resp.Payload, &c.capabilities, c.crypto)
+		} else {
+			// Server predates codec negotiation.
+			c.capabilities.Codecs = 1<<constants.CODEC_NONE | 1<<constants.CODEC_LZ4
+		}
+		if c.capabilities.Hashes == 0 {
+			// Server predates checksum algorithm negotiation.
+			c.capabilities.Hashes = 1<<constants.HASH_CRC32 | 1<<constants.HASH_SHA256
+		}
 	}
 	return c.crypto, nil
 }
 
-// Initiate tells server to prepare to receive file of given name
-func (c *Client) Initiate(root, file string, hash []byte, hashingMethod uint8) uint8 {
+// SupportsCodec returns true if server announced support for given compression codec
+func (c *Client) SupportsCodec(codec uint16) bool {
+	return c.capabilities.Codecs&(1<<codec) != 0
+}
+
+// SupportsHash returns true if server announced support for given checksum algorithm
+func (c *Client) SupportsHash(algorithm uint8) bool {
+	return c.capabilities.Hashes&(1<<algorithm) != 0
+}
+
+// SendDictionary shares compression dictionary with server for rest of the session
+func (c *Client) SendDictionary(dict []byte) bool {
+	announce := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.DICTIONARY,
+		},
+	}
+
+	block := &networking.DictionaryBlock{
+		Checksum: crc32.ChecksumIEEE(dict),
+		BlockLen: uint32(len(dict)),
+	}
+	announce.Payload = networking.PayloadToBytes(block, c.crypto)
+	out, _ := networking.PacketToBytes(&announce)
+	out = append(out, c.crypto.Encrypt(dict)...)
+
+	c.socket.Write(out)
+
+	resp := c.readResponse(opcode.DICTIONARY)
+
+	return resp != nil && resp.Flags == 1
+}
+
+// RemoteName returns name of file on server relative to its root. Root is local folder being sent or empty
+// if sending single file.
+func RemoteName(root, file string) string {
 	subfolder := ""
 
 	if len(root) > 0 {
@@ -125,12 +184,79 @@ func (c *Client) Initiate(root, file string, hash []byte, hashingMethod uint8) u
 		}
 	}
 
-	file = filepath.Base(file)
+	return subfolder + filepath.Base(file)
+}
+
+// nameHeader returns encrypted tar header carrying only name of file on server
+func (c *Client) nameHeader(name string) []byte {
+	buffer := new(bytes.Buffer)
+	tarra := tar.NewWriter(buffer)
+	tarra.WriteHeader(&tar.Header{
+		Format:   tar.FormatPAX,
+		Typeflag: tar.TypeReg,
+		Name:     name,
+	})
+	tarra.Close()
+	return c.crypto.Encrypt(buffer.Bytes())
+}
+
+// ListFiles returns all files stored by server. Names are relative to its root.
+func (c *Client) ListFiles() []*tar.Header {
+	request := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.LIST,
+		},
+	}
+	out, _ := networking.PacketToBytes(&request)
+	c.socket.Write(out)
+
+	files := make([]*tar.Header, 0)
+	for {
+		resp := c.readResponse(opcode.LIST)
+		if resp == nil {
+			return nil
+		}
+		if len(resp.Payload) > 0 {
+			header, err := tar.NewReader(bytes.NewBuffer(c.crypto.Decrypt(resp.Payload))).Next()
+			if err != nil {
+				return nil
+			}
+			files = append(files, header)
+		}
+		// 0: last message, 1: more to follow
+		if resp.Flags == 0 {
+			return files
+		}
+	}
+}
+
+// RemoteChecksum returns checksum of file stored by server. Returns nil if server does not have the file.
+func (c *Client) RemoteChecksum(name string, algorithm uint8) []byte {
+	request := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.CHECKSUM,
+			Flags:  algorithm,
+		},
+	}
+	request.Payload = c.nameHeader(name)
+	out, _ := networking.PacketToBytes(&request)
+	c.socket.Write(out)
+
+	resp := c.readResponse(opcode.CHECKSUM)
+	if resp == nil || resp.Flags != 1 {
+		return nil
+	}
+	return c.crypto.Decrypt(resp.Payload)
+}
+
+// Initiate tells server to prepare to receive file under given name. Records are passed on as PAX records.
+func (c *Client) Initiate(name string, info os.FileInfo, hash []byte, hashingMethod uint8,
+	records map[string]string) uint8 {
 
 	fileTransfer := networking.Packet{
 		Header: networking.Header{
 			Opcode: opcode.BEGINFILETRANSFER,
-			Flags:  hashingMethod, // 0: disabled, 1: crc32, 2: sha256
+			Flags:  hashingMethod, // Checksum algorithm, 0: disabled
 		},
 	}
 
@@ -138,14 +264,23 @@ func (c *Client) Initiate(root, file string, hash []byte, hashingMethod uint8) u
 	tarra := tar.NewWriter(buffer)
 	defer tarra.Close()
 
+	paxRecords := make(map[string]string)
+	if hash != nil {
+		// Server compares checksum instead of size and modification time.
+		paxRecords[constants.PAXAttr] = hex.EncodeToString(hash)
+	}
+	for key, value := range records {
+		paxRecords[key] = value
+	}
+
 	// Write tar header to buffer.
 	tarra.WriteHeader(&tar.Header{
-		Format:   tar.FormatPAX,
-		Typeflag: tar.TypeReg,
-		Name:     subfolder + file,
-		PAXRecords: map[string]string{
-			constants.PAXAttr: hex.EncodeToString(hash),
-		},
+		Format:     tar.FormatPAX,
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		PAXRecords: paxRecords,
 	})
 
 	tarHdrBytes := buffer.Bytes()
@@ -167,12 +302,81 @@ func (c *Client) Initiate(root, file string, hash []byte, hashingMethod uint8) u
 	return 0
 }
 
+// ReadSignatures receives block signatures of the version of file server already has
+func (c *Client) ReadSignatures() *fileio.Signatures {
+	sigs := new(fileio.Signatures)
+	headerLen := binary.Size(networking.SignatureBlock{})
+
+	for {
+		resp := c.readResponse(opcode.SIGNATURES)
+		if resp == nil || len(resp.Payload) < headerLen {
+			return nil
+		}
+
+		payload := c.crypto.Decrypt(resp.Payload)
+
+		var block networking.SignatureBlock
+		if networking.DecodePayload(payload[:headerLen], &block, nil) != nil {
+			return nil
+		}
+		blocks := make([]fileio.BlockSignature, block.Count)
+		if networking.DecodePayload(payload[headerLen:], blocks, nil) != nil {
+			return nil
+		}
+
+		sigs.BlockSize = int(block.BlockSize)
+		sigs.Blocks = append(sigs.Blocks, blocks...)
+
+		// Last message of signatures.
+		if resp.Flags == 0 {
+			return sigs
+		}
+	}
+}
+
+// QueryChunks asks server which of the chunks it already has in its chunk store
+func (c *Client) QueryChunks(hashes [][32]byte) map[[32]byte]bool {
+	present := make(map[[32]byte]bool)
+
+	for sent := 0; sent < len(hashes); {
+		count := min(len(hashes)-sent, constants.HASHES_PER_QUERY)
+		batch := hashes[sent : sent+count]
+
+		query := networking.Packet{
+			Header: networking.Header{
+				Opcode: opcode.CHUNKQUERY,
+			},
+		}
+		payload := networking.PayloadToBytes(&networking.ChunkQuery{Count: uint16(count)}, nil)
+		payload = append(payload, networking.PayloadToBytes(batch, nil)...)
+		query.Payload = c.crypto.Encrypt(payload)
+
+		out, _ := networking.PacketToBytes(&query)
+		c.socket.Write(out)
+
+		resp := c.readResponse(opcode.CHUNKQUERY)
+		if resp == nil || len(resp.Payload) < (count+7)/8 {
+			return nil
+		}
+		bitmap := c.crypto.Decrypt(resp.Payload)
+		for i, hash := range batch {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				present[hash] = true
+			}
+		}
+
+		sent += count
+	}
+
+	return present
+}
+
 // EndFileTransfer tells server current session is terminating
-func (c *Client) EndFileTransfer(file string, hash []byte, hashingMethod uint8) bool {
+func (c *Client) EndFileTransfer(file string, hash []byte, hashingMethod uint8, tree *fileio.MerkleTree) bool {
 	end := networking.Packet{
 		Header: networking.Header{
 			Opcode: opcode.ENDFILETRANSFER,
-			Flags:  hashingMethod, // 0: disabled, 1: crc32, 2: sha256
+			Flags:  hashingMethod, // Checksum algorithm, 0: disabled
 		},
 	}
 
@@ -181,6 +385,10 @@ func (c *Client) EndFileTransfer(file string, hash []byte, hashingMethod uint8)
 	}
 
 	copy(eof.Checksum[:], hash)
+	if tree != nil {
+		eof.Root = tree.Root()
+		eof.Size = tree.Size()
+	}
 
 	end.Payload = networking.PayloadToBytes(eof, c.crypto)
 
@@ -188,7 +396,17 @@ func (c *Client) EndFileTransfer(file string, hash []byte, hashingMethod uint8)
 	c.socket.Write(out)
 
 	// Wait for server ack.
-	resp := c.readResponse(opcode.ENDFILETRANSFER)
+	resp := c.awaitEndResponse(out)
+
+	// 3: Checksum mismatch but server can compare hash trees to find corrupted blocks.
+	if resp != nil && resp.Flags == 3 && tree != nil {
+		if !c.repairFile(file, tree) {
+			return false
+		}
+		// Have server check the file again.
+		c.socket.Write(out)
+		resp = c.readResponse(opcode.ENDFILETRANSFER)
+	}
 
 	if resp != nil {
 		if resp.Flags > 0 {
@@ -204,8 +422,139 @@ func (c *Client) EndFileTransfer(file string, hash []byte, hashingMethod uint8)
 	return false
 }
 
+// Unsent returns true if file transfer failed as chunk server asked for could not be sent again
+func (c *Client) Unsent() bool {
+	return c.unsent
+}
+
+// UseRetransmit keeps recently sent chunks so the ones server could not verify can be sent again
+func (c *Client) UseRetransmit() {
+	c.retransmit = true
+}
+
+// Sent returns original size of data of file sent so far
+func (c *Client) Sent() uint64 {
+	return c.sent.Load()
+}
+
+// UseRateLimit limits bandwidth of file data sent to server
+func (c *Client) UseRateLimit(limiter *networking.RateLimiter) {
+	c.limiter = limiter
+}
+
+// repairFile compares hash tree of file with the one on server and sends blocks which differ again
+func (c *Client) repairFile(file string, tree *fileio.MerkleTree) bool {
+	corrupted := tree.Diff(c.QueryTree)
+	if len(corrupted) == 0 {
+		return false
+	}
+	fmt.Println("Server has", len(corrupted), "corrupted blocks. Sending them again")
+
+	handle, err := os.Open(file)
+	if err != nil {
+		fmt.Println(err.Error())
+		return false
+	}
+	defer handle.Close()
+
+	for _, leaf := range corrupted {
+		offset, length := tree.Block(leaf)
+		data := make([]byte, length)
+		if _, err := handle.ReadAt(data, int64(offset)); err != nil {
+			fmt.Println(err.Error())
+			return false
+		}
+
+		repair := networking.Packet{
+			Header: networking.Header{
+				Opcode: opcode.REPAIR,
+			},
+		}
+		repair.Payload = networking.PayloadToBytes(&networking.BlockRepair{
+			Offset: offset,
+			Length: uint32(length),
+		}, c.crypto)
+		out, _ := networking.PacketToBytes(&repair)
+		c.limiter.Wait(len(out) + len(data))
+		c.socket.Write(append(out, c.crypto.Encrypt(data)...))
+	}
+
+	return true
+}
+
+// RequestTree asks server to build hash tree of its copy of file. Returns nil if server does not have the file.
+func (c *Client) RequestTree(name string) *networking.TreeInfo {
+	request := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.TREE,
+		},
+	}
+
+	request.Payload = c.nameHeader(name)
+
+	out, _ := networking.PacketToBytes(&request)
+	c.socket.Write(out)
+
+	resp := c.readResponse(opcode.TREE)
+	if resp == nil || resp.Flags != 1 {
+		return nil
+	}
+
+	var info networking.TreeInfo
+	if networking.DecodePayload(resp.Payload, &info, c.crypto) != nil {
+		return nil
+	}
+	return &info
+}
+
+// QueryTree returns hashes of nodes at given level of hash tree on server
+func (c *Client) QueryTree(level int, indexes []uint32) [][32]byte {
+	hashes := make([][32]byte, 0, len(indexes))
+
+	for sent := 0; sent < len(indexes); {
+		count := min(len(indexes)-sent, constants.HASHES_PER_QUERY)
+
+		query := networking.Packet{
+			Header: networking.Header{
+				Opcode: opcode.TREEQUERY,
+			},
+		}
+		payload := networking.PayloadToBytes(&networking.TreeQuery{Level: uint8(level), Count: uint16(count)}, nil)
+		payload = append(payload, networking.PayloadToBytes(indexes[sent:sent+count], nil)...)
+		query.Payload = c.crypto.Encrypt(payload)
+
+		out, _ := networking.PacketToBytes(&query)
+		c.socket.Write(out)
+
+		resp := c.readResponse(opcode.TREEQUERY)
+		if resp == nil {
+			return nil
+		}
+		batch := make([][32]byte, count)
+		if networking.DecodePayload(resp.Payload, batch, c.crypto) != nil {
+			return nil
+		}
+		hashes = append(hashes, batch...)
+
+		sent += count
+	}
+
+	return hashes
+}
+
 // StartChunkStream streams processed chunk data to server
-func (c *Client) StartChunkStream(channels []chan []byte) {
+func (c *Client) StartChunkStream(channels []chan *networking.ChunkMessage) {
+	c.sent.Store(0)
+	if c.retransmit {
+		c.window = make(map[uint32][]byte)
+		c.windowOrder = make([]uint32, 0, constants.RETRANSMIT_WINDOW)
+		c.retransmits = make(map[uint32]int)
+		c.unsent = false
+		c.nacks = make(chan uint32, constants.RETRANSMIT_WINDOW)
+		c.responses = make(chan *networking.Packet, 1)
+		go c.readNacks()
+	}
+
 	lastWork := time.Now()
 	for {
 		closed := 0
@@ -215,6 +564,10 @@ func (c *Client) StartChunkStream(channels []chan []byte) {
 			closed += closeInc
 			didWork = didWork || ready
 		}
+		// Send again chunks server could not verify.
+		for c.processNack() {
+			didWork = true
+		}
 		if closed == len(channels) {
 			break
 		}
@@ -230,17 +583,24 @@ func (c *Client) StartChunkStream(channels []chan []byte) {
 
 // processCompletedChunkChannel performs non-blocking read on worker channels and sends data if available.
 // Return value is increment for # of closed channels and boolean whether channel produced anything.
-func (c *Client) processCompletedChunkChannel(chonker chan []byte) (int, bool) {
+func (c *Client) processCompletedChunkChannel(chonker chan *networking.ChunkMessage) (int, bool) {
 	select {
 	case msg, open := <-chonker:
 		if msg == nil {
 			return 1, true
 		}
 
-		_, err := c.socket.Write(msg)
+		c.limiter.Wait(len(msg.Data))
+		_, err := c.socket.Write(msg.Data)
 
 		if err != nil {
-			panic(err)
+			c.lost()
+		}
+
+		c.sent.Add(uint64(msg.Size))
+
+		if c.window != nil {
+			c.remember(msg)
 		}
 
 		var closed int
@@ -254,6 +614,111 @@ func (c *Client) processCompletedChunkChannel(chonker chan []byte) (int, bool) {
 	}
 }
 
+// remember keeps chunk in retransmit window dropping the oldest one once window is full
+func (c *Client) remember(msg *networking.ChunkMessage) {
+	if len(c.windowOrder) == constants.RETRANSMIT_WINDOW {
+		delete(c.window, c.windowOrder[0])
+		c.windowOrder = c.windowOrder[1:]
+	}
+	c.window[msg.Seq] = msg.Data
+	c.windowOrder = append(c.windowOrder, msg.Seq)
+}
+
+// processNack performs non-blocking read of chunks server asked for and sends one again if available
+func (c *Client) processNack() bool {
+	select {
+	case seq := <-c.nacks:
+		c.retransmitChunk(seq)
+		return true
+	default:
+		return false
+	}
+}
+
+// retransmitChunk sends chunk with given sequence number again
+func (c *Client) retransmitChunk(seq uint32) {
+	msg, found := c.window[seq]
+	c.retransmits[seq]++
+	if !found || c.retransmits[seq] > constants.MAX_RETRANSMITS {
+		// Server keeps waiting for chunk, so file transfer can't be completed.
+		fmt.Println("Chunk", seq, "failed verification and can not be sent again")
+		c.unsent = true
+		return
+	}
+	fmt.Println("Chunk", seq, "failed verification. Sending it again")
+	c.limiter.Wait(len(msg))
+	if _, err := c.socket.Write(msg); err != nil {
+		c.lost()
+	}
+}
+
+// readNacks reads messages from server while file is being sent until file transfer has been confirmed
+func (c *Client) readNacks() {
+	for {
+		packet := c.readPacket()
+		if packet == nil {
+			c.responses <- nil
+			return
+		}
+		switch packet.Opcode {
+		case opcode.NACK:
+			var nack networking.ChunkNack
+			if networking.DecodePayload(packet.Payload, &nack, c.crypto) == nil {
+				c.nacks <- nack.Sequence
+			}
+		case opcode.ENDFILETRANSFER:
+			c.responses <- packet
+			// 2: Chunks still pending retransmission.
+			if packet.Flags != 2 {
+				return
+			}
+		}
+	}
+}
+
+// awaitEndResponse waits for server to confirm end of file transfer sending again any chunks it asks for
+func (c *Client) awaitEndResponse(end []byte) *networking.Packet {
+	if c.responses == nil {
+		return c.readResponse(opcode.ENDFILETRANSFER)
+	}
+	defer func() {
+		c.window = nil
+		c.responses = nil
+	}()
+
+	for {
+		select {
+		case seq := <-c.nacks:
+			c.retransmitChunk(seq)
+		case resp := <-c.responses:
+			if resp == nil || resp.Flags != 2 {
+				return resp
+			}
+			if c.unsent {
+				return nil
+			}
+			// Server is waiting for chunks it asked for. Send them before asking again.
+			for c.processNack() {
+			}
+			c.socket.Write(end)
+		}
+	}
+}
+
+// OnLost sets function which ends client once connection to server is lost instead of exiting right away
+func (c *Client) OnLost(exit func(code int)) {
+	c.exit = exit
+}
+
+// lost ends client as connection to server has been lost
+func (c *Client) lost() {
+	fmt.Println("Lost connection")
+	if c.exit != nil {
+		c.exit(constants.EXIT_LOST)
+	}
+	os.Exit(constants.EXIT_LOST)
+}
+
 // Close closes socket
 func (c *Client) Close() {
 	c.socket.Close()
@@ -261,14 +726,24 @@ func (c *Client) Close() {
 
 // readResponse reads full message from stream and matches it to opcode
 func (c *Client) readResponse(opcode uint8) *networking.Packet {
+	packet := c.readPacket()
+
+	if packet == nil || packet.Opcode != opcode {
+		return nil
+	}
+
+	return packet
+}
+
+// readPacket reads full message from stream
+func (c *Client) readPacket() *networking.Packet {
 	msg := make([]byte, 4)
 
 	// Read message header first.
 	_, err := io.ReadFull(c.socket, msg)
 
 	if err != nil {
-		fmt.Println("Lost connection")
-		os.Exit(3)
+		c.lost()
 	}
 
 	// decode 4 bytes as Header.
@@ -297,9 +772,5 @@ func (c *Client) readResponse(opcode uint8) *networking.Packet {
 		}
 	}
 
-	if packet.Opcode != opcode {
-		return nil
-	}
-
 	return packet
 }
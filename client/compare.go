@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go_fast_copy/client/comms"
+	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// compareEntry describes how local file compares with file on server
+type compareEntry struct {
+	Path       string `json:"path"`
+	Status     string `json:"status"` // ok, missing, extra, size_mismatch or checksum_mismatch
+	LocalSize  int64  `json:"local_size,omitempty"`
+	RemoteSize int64  `json:"remote_size,omitempty"`
+}
+
+// compareReport is result of comparing local files with server
+type compareReport struct {
+	Files   []compareEntry `json:"files"`
+	Summary map[string]int `json:"summary"`
+}
+
+// compareFiles compares local files with the ones on server without transferring anything. Files only found
+// on server are reported when comparing contents of a folder unless filter excludes them or they are outside
+// destination folder.
+func compareFiles(client *comms.Client, rootdir, destination string, files []fileEntry, algorithm uint8,
+	filter *fileFilter) *compareReport {
+	report := &compareReport{Summary: map[string]int{
+		"ok": 0, "missing": 0, "extra": 0, "size_mismatch": 0, "checksum_mismatch": 0,
+	}}
+
+	remote := make(map[string]int64)
+	if rootdir != "" {
+		listing := client.ListFiles()
+		if listing == nil {
+			fmt.Fprintln(os.Stderr, "Could not list files on server")
+			os.Exit(constants.EXIT_ERROR)
+		}
+		for _, header := range listing {
+			name, found := header.Name, true
+			if destination != "" {
+				name, found = strings.CutPrefix(name, destination+"/")
+			}
+			if found && filter.Matches(rootdir, name, header.Size, header.ModTime) {
+				remote[header.Name] = header.Size
+			}
+		}
+	}
+
+	for _, file := range files {
+		name := file.name
+		entry := compareEntry{Path: filepath.ToSlash(name)}
+
+		info, err := os.Stat(file.path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+		entry.LocalSize = info.Size()
+
+		remoteSize, listed := remote[entry.Path]
+		delete(remote, entry.Path)
+
+		var checksum []byte
+		if rootdir == "" || listed {
+			checksum = client.RemoteChecksum(name, algorithm)
+		}
+
+		switch {
+		case checksum == nil:
+			entry.Status = "missing"
+		case listed && remoteSize != info.Size():
+			entry.Status = "size_mismatch"
+			entry.RemoteSize = remoteSize
+		case !bytes.Equal(checksum, fileio.GetFileChecksum(file.path, algorithm)):
+			entry.Status = "checksum_mismatch"
+		default:
+			entry.Status = "ok"
+		}
+		report.add(entry)
+	}
+
+	// Whatever was not found locally only exists on server.
+	extra := make([]string, 0, len(remote))
+	for name := range remote {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		report.add(compareEntry{Path: name, Status: "extra", RemoteSize: remote[name]})
+	}
+
+	return report
+}
+
+// add adds entry to report
+func (r *compareReport) add(entry compareEntry) {
+	r.Files = append(r.Files, entry)
+	r.Summary[entry.Status]++
+}
+
+// Matches returns true if no differences were found
+func (r *compareReport) Matches() bool {
+	return r.Summary["ok"] == len(r.Files)
+}
+
+// Print writes report in human-readable form or as JSON
+func (r *compareReport) Print(out io.Writer, asJSON bool) {
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(r)
+		return
+	}
+
+	for _, entry := range r.Files {
+		switch entry.Status {
+		case "ok":
+			continue
+		case "size_mismatch":
+			fmt.Fprintln(out, "SIZE MISMATCH    ", entry.Path, "(local", entry.LocalSize, "bytes, server", entry.RemoteSize, "bytes)")
+		default:
+			fmt.Fprintf(out, "%-17s %s\n", strings.ToUpper(strings.ReplaceAll(entry.Status, "_", " ")), entry.Path)
+		}
+	}
+	fmt.Fprintln(out, "Compared", len(r.Files), "files:", r.Summary["ok"], "ok,", r.Summary["missing"], "missing,",
+		r.Summary["extra"], "extra,", r.Summary["size_mismatch"], "size mismatch,",
+		r.Summary["checksum_mismatch"], "checksum mismatch")
+}
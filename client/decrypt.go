@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"io"
+	"os"
+
+	"github.com/akamensky/argparse"
+)
+
+// decrypt writes original contents of file sent with end-to-end encryption, or original path of encrypted name
+func decrypt(arguments []string) {
+	args := argparse.NewParser("client decrypt", "Decrypt file or file name sent with end-to-end encryption")
+
+	keyFile := args.String("", "e2e-key", &argparse.Options{Required: true, Help: "File containing key files were encrypted with"})
+	input := args.String("i", "input", &argparse.Options{Help: "Encrypted file path (- for stdin)"})
+	output := args.String("o", "output", &argparse.Options{Help: "Output file path (- for stdout)", Default: "-"})
+	name := args.String("", "name", &argparse.Options{Help: "Print original path of encrypted path instead"})
+
+	err := args.Parse(arguments)
+
+	if err != nil {
+		fmt.Print(args.Usage(err))
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	key, err := fileio.LoadKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load key -", err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	if *name != "" {
+		names, _ := fileio.NewNameCipher(key)
+		original, err := names.Decrypt(*name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(constants.EXIT_ERROR)
+		}
+		fmt.Println(original)
+		return
+	} else if *input == "" {
+		fmt.Fprintln(os.Stderr, "Please use -i to provide encrypted file or --name to provide encrypted path.")
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	in := os.Stdin
+	if *input != "-" {
+		if in, err = os.Open(*input); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(constants.EXIT_ERROR)
+		}
+		defer in.Close()
+	}
+
+	reader, err := fileio.NewEndToEndReader(in, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(constants.EXIT_ERROR)
+		}
+		defer out.Close()
+	}
+
+	if _, err = io.Copy(out, reader); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+}
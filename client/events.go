@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// eventFields holds fields of single event
+type eventFields map[string]interface{}
+
+// eventLog writes newline-delimited JSON events of session and keeps count of files for summary
+type eventLog struct {
+	encoder   *json.Encoder
+	lock      sync.Mutex
+	start     time.Time
+	completed int
+	skipped   int
+	failed    int
+	bytes     uint64
+}
+
+// newEventLog returns event log writing to given output
+func newEventLog(out io.Writer) *eventLog {
+	return &eventLog{encoder: json.NewEncoder(out), start: time.Now()}
+}
+
+// Emit writes event of given kind with given fields. Does nothing if log is nil.
+func (e *eventLog) Emit(kind string, fields eventFields) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.write(kind, fields)
+}
+
+// write counts file events for summary and writes event. Lock must be held.
+func (e *eventLog) write(kind string, fields eventFields) {
+	switch kind {
+	case "file_completed":
+		e.completed++
+		if size, ok := fields["size"].(uint64); ok {
+			e.bytes += size
+		}
+	case "file_skipped":
+		e.skipped++
+	case "file_failed", "checksum_mismatch":
+		e.failed++
+	}
+
+	fields["event"] = kind
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	e.encoder.Encode(fields)
+}
+
+// File emits event of given kind about file along with extra fields. Name is the one given on client even if
+// names are encrypted.
+func (e *eventLog) File(kind string, entry fileEntry, size uint64, extra eventFields) {
+	if e == nil {
+		return
+	}
+	fields := eventFields{"file": entry.path, "name": filepath.ToSlash(entry.name), "size": size}
+	for key, value := range extra {
+		fields[key] = value
+	}
+	e.Emit(kind, fields)
+}
+
+// Progress emits progress of file being sent
+func (e *eventLog) Progress(entry fileEntry, bar *progressBar, stats *progressStats) {
+	fields := eventFields{
+		"sent":         stats.sent,
+		"rate":         uint64(stats.rate),
+		"average_rate": uint64(stats.average),
+		"ratio":        stats.ratio,
+		"eta_seconds":  int64(stats.eta.Seconds()),
+	}
+	if bar.total > 0 {
+		fields["total_sent"] = bar.done + stats.sent
+		fields["total"] = bar.total
+	}
+	e.File("progress", entry, stats.size, fields)
+}
+
+// Exit emits summary of session and ends client with given exit code. Every exit after arguments have been parsed
+// goes through here so summary is never missed.
+func (e *eventLog) Exit(code int) {
+	e.Summary(code)
+	os.Exit(code)
+}
+
+// Summary emits summary of session ending with given exit code
+func (e *eventLog) Summary(code int) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.write("summary", eventFields{
+		"files":       e.completed + e.skipped + e.failed,
+		"completed":   e.completed,
+		"skipped":     e.skipped,
+		"failed":      e.failed,
+		"bytes":       e.bytes,
+		"duration_ms": time.Since(e.start).Milliseconds(),
+		"exit_code":   code,
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"go_fast_copy/client/comms"
+	"go_fast_copy/constants"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileEntry is local file to send along with its name on server
+type fileEntry struct {
+	path    string
+	name    string
+	source  io.Reader         // Contents are read from here instead of file at path if set
+	info    os.FileInfo       // Info of contents read from source
+	records map[string]string // Additional PAX records sent to server
+}
+
+// streamInfo describes data of unknown length read from standard input
+type streamInfo struct {
+	modTime time.Time
+}
+
+func (s streamInfo) Name() string       { return "-" }
+func (s streamInfo) Size() int64        { return 0 }
+func (s streamInfo) Mode() fs.FileMode  { return 0 }
+func (s streamInfo) ModTime() time.Time { return s.modTime }
+func (s streamInfo) IsDir() bool        { return false }
+func (s streamInfo) Sys() any           { return nil }
+
+// stdinEntry returns entry reading data of unknown length from standard input. It's considered to have been
+// modified now.
+func stdinEntry(name string) fileEntry {
+	return fileEntry{
+		path:   "-",
+		name:   name,
+		source: os.Stdin,
+		info:   streamInfo{modTime: time.Now()},
+		// Size and checksum are only known once stream ends.
+		records: map[string]string{constants.PAXStream: "1"},
+	}
+}
+
+// statEntry returns file info of entry
+func statEntry(entry fileEntry) (os.FileInfo, error) {
+	if entry.info != nil {
+		return entry.info, nil
+	}
+	return os.Stat(entry.path)
+}
+
+// listEntries pairs files found under root folder with their names on server. Root is empty if sending single file.
+func listEntries(root string, files []string) []fileEntry {
+	entries := make([]fileEntry, len(files))
+	for i, file := range files {
+		entries[i] = fileEntry{path: file, name: comms.RemoteName(root, file)}
+	}
+	return entries
+}
+
+// entryPaths returns local paths of entries
+func entryPaths(entries []fileEntry) []string {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.path
+	}
+	return paths
+}
+
+// destinationName returns name of file on server given destination. Destination ending with slash is folder
+// under which file is placed, otherwise it replaces name of file. Leading slash refers to root of server.
+func destinationName(dest, name string) (string, error) {
+	dest = strings.ReplaceAll(dest, "\\", "/")
+	folder := strings.HasSuffix(dest, "/")
+	dest = strings.TrimLeft(dest, "/")
+	if dest == "" && folder {
+		return name, nil
+	}
+	dest = filepath.Clean(filepath.FromSlash(dest))
+	if !filepath.IsLocal(dest) {
+		return "", errors.New("destination must be under root of server: " + dest)
+	}
+	if folder {
+		return filepath.Join(dest, name), nil
+	}
+	return dest, nil
+}
+
+// withDestination places entries under given folder on server. Single file may also be renamed.
+func withDestination(entries []fileEntry, dest string, single bool) error {
+	if !single && !strings.HasSuffix(dest, "/") {
+		dest += "/"
+	}
+	for i := range entries {
+		name, err := destinationName(dest, entries[i].name)
+		if err != nil {
+			return err
+		}
+		entries[i].name = name
+	}
+	return nil
+}
+
+// readFileList reads list of files to send from given file or standard input if name is -. Entries are separated
+// by newlines or null characters and may map local path to name on server separated by tab. Lines starting with #
+// are comments unless entries are separated by null characters. Relative paths are relative to base folder which
+// also determines name on server of entries without mapping.
+func readFileList(name, base string, null bool) ([]fileEntry, error) {
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	separator := byte('\n')
+	if null {
+		separator = 0
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, separator); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	entries := make([]fileEntry, 0)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !null {
+			line = strings.TrimRight(line, "\r")
+		}
+		if line == "" || !null && strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		source, dest, mapped := strings.Cut(line, "\t")
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(base, source)
+		}
+		source = filepath.Clean(source)
+
+		if mapped {
+			dest = strings.ReplaceAll(dest, "\\", "/")
+			if !filepath.IsLocal(filepath.FromSlash(dest)) {
+				return nil, errors.New("invalid name on server: " + dest)
+			}
+			dest = filepath.Clean(filepath.FromSlash(dest))
+		} else if relative, err := filepath.Rel(base, source); err == nil && filepath.IsLocal(relative) {
+			dest = relative
+		} else {
+			// Files outside base folder are stored under their name only.
+			dest = filepath.Base(source)
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, errors.New(source + " is a directory")
+		}
+		entries = append(entries, fileEntry{path: source, name: dest})
+	}
+	return entries, scanner.Err()
+}
+
+// entriesSize returns total size of files to send, zero if any of them is read from stream
+func entriesSize(entries []fileEntry) uint64 {
+	var total uint64
+	for _, entry := range entries {
+		if entry.source != nil {
+			return 0
+		}
+		if info, err := os.Stat(entry.path); err == nil {
+			total += uint64(info.Size())
+		}
+	}
+	return total
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadFileList(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	for _, name := range []string{"a.txt", "sub/b.txt", "#hash.txt"} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+	}
+	os.WriteFile(filepath.Join(outside, "c.txt"), []byte("c"), 0644)
+	escape, _ := filepath.Rel(base, filepath.Join(outside, "c.txt"))
+
+	tests := []struct {
+		name string
+		list string
+		null bool
+		want []string // Local path relative to base and name on server separated by tab
+		err  bool
+	}{
+		{"relative paths", "a.txt\nsub/b.txt\n", false,
+			[]string{"a.txt\ta.txt", "sub/b.txt\tsub/b.txt"}, false},
+		{"blank lines", "\n\na.txt\r\n\n", false, []string{"a.txt\ta.txt"}, false},
+		{"comments", "# files to send\na.txt\n#sub/b.txt\n", false, []string{"a.txt\ta.txt"}, false},
+		{"no final newline", "a.txt", false, []string{"a.txt\ta.txt"}, false},
+		{"null separated", "a.txt\x00#hash.txt\x00sub/b.txt", true,
+			[]string{"a.txt\ta.txt", "#hash.txt\t#hash.txt", "sub/b.txt\tsub/b.txt"}, false},
+		{"absolute path", filepath.Join(base, "sub", "b.txt") + "\n", false, []string{"sub/b.txt\tsub/b.txt"}, false},
+		{"mapped", "a.txt\tdocs/renamed.txt\n", false, []string{"a.txt\tdocs/renamed.txt"}, false},
+		{"mapped with dots", "a.txt\tdocs/../other/./a.txt\n", false, []string{"a.txt\tother/a.txt"}, false},
+		{"outside base", escape + "\n", false, []string{escape + "\tc.txt"}, false},
+		{"mapped escaping root", "a.txt\t../a.txt\n", false, nil, true},
+		{"mapped absolute name", "a.txt\t/etc/a.txt\n", false, nil, true},
+		{"missing file", "missing.txt\n", false, nil, true},
+		{"folder", "sub\n", false, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listFile := filepath.Join(t.TempDir(), "list")
+			os.WriteFile(listFile, []byte(test.list), 0644)
+
+			entries, err := readFileList(listFile, base, test.null)
+			if (err != nil) != test.err {
+				t.Fatalf("readFileList error %v", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				relative, _ := filepath.Rel(base, entry.path)
+				got = append(got, filepath.ToSlash(relative)+"\t"+filepath.ToSlash(entry.name))
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("entries %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDestinationName(t *testing.T) {
+	tests := []struct {
+		dest string
+		name string
+		want string
+		err  bool
+	}{
+		{"backup/", "file.txt", "backup/file.txt", false},
+		{"backup/", "sub/file.txt", "backup/sub/file.txt", false},
+		{"renamed.txt", "file.txt", "renamed.txt", false},
+		{"backup/renamed.txt", "file.txt", "backup/renamed.txt", false},
+		{"/", "file.txt", "file.txt", false},
+		{"/backup/", "file.txt", "backup/file.txt", false},
+		{"//backup//", "file.txt", "backup/file.txt", false},
+		{"backup\\daily\\", "file.txt", "backup/daily/file.txt", false},
+		{"backup/../other/", "file.txt", "other/file.txt", false},
+		{"./", "file.txt", "file.txt", false},
+		{"../", "file.txt", "", true},
+		{"backup/../../", "file.txt", "", true},
+		{"..", "file.txt", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.dest+" "+test.name, func(t *testing.T) {
+			name, err := destinationName(test.dest, filepath.FromSlash(test.name))
+			if (err != nil) != test.err || filepath.ToSlash(name) != test.want {
+				t.Errorf("destinationName = %q, %v, want %q", name, err, test.want)
+			}
+		})
+	}
+}
+
+func TestWithDestination(t *testing.T) {
+	tests := []struct {
+		name   string
+		dest   string
+		single bool
+		names  []string
+		want   []string
+		err    bool
+	}{
+		{"single renamed", "renamed.txt", true, []string{"file.txt"}, []string{"renamed.txt"}, false},
+		{"single in folder", "backup/", true, []string{"file.txt"}, []string{"backup/file.txt"}, false},
+		{"many always in folder", "backup", false, []string{"a.txt", "sub/b.txt"},
+			[]string{"backup/a.txt", "backup/sub/b.txt"}, false},
+		{"many at root", "/", false, []string{"a.txt", "sub/b.txt"}, []string{"a.txt", "sub/b.txt"}, false},
+		{"escaping root", "..", false, []string{"a.txt"}, []string{"a.txt"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := make([]fileEntry, len(test.names))
+			for i, name := range test.names {
+				entries[i] = fileEntry{name: filepath.FromSlash(name)}
+			}
+			err := withDestination(entries, test.dest, test.single)
+			if (err != nil) != test.err {
+				t.Fatalf("withDestination error %v", err)
+			}
+			for i, entry := range entries {
+				if filepath.ToSlash(entry.name) != test.want[i] {
+					t.Errorf("entry %d named %q, want %q", i, entry.name, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileFilter decides which files under root folder are sent. Names are slash-separated paths relative to root.
+type fileFilter struct {
+	includes    []pattern
+	excludes    []pattern
+	minSize     int64
+	maxSize     int64 // 0 for no limit
+	newerThan   time.Time
+	ignoreFiles []string // Names of per-folder ignore files to honor
+}
+
+// pattern is glob matched either against file name or entire relative path
+type pattern struct {
+	segments []string
+	anchored bool // Contains slash so matched against path instead of file name
+	dirOnly  bool // Ends with slash so only matches folders
+	negate   bool // Starts with ! in ignore file so re-includes what was ignored
+}
+
+// ignoreRule is pattern read from ignore file of folder which applies to everything under that folder
+type ignoreRule struct {
+	base string
+	pattern
+}
+
+// filterOptions holds filter settings as given on command line
+type filterOptions struct {
+	includes    []string
+	excludes    []string
+	excludeFrom []string
+	minSize     string
+	maxSize     string
+	newerThan   string
+	gitignore   bool
+}
+
+// newFileFilter parses filter settings or returns error describing what's wrong with them
+func newFileFilter(options filterOptions) (*fileFilter, error) {
+	f := &fileFilter{ignoreFiles: []string{".gfcignore"}}
+	if options.gitignore {
+		f.ignoreFiles = append([]string{".gitignore"}, f.ignoreFiles...)
+	}
+
+	for _, expr := range options.includes {
+		p, err := parsePattern(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, p)
+	}
+
+	excludes := options.excludes
+	for _, name := range options.excludeFrom {
+		lines, err := readPatternFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			// Backslash escapes leading #.
+			excludes = append(excludes, strings.TrimPrefix(line, "\\"))
+		}
+	}
+	for _, expr := range excludes {
+		p, err := parsePattern(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, p)
+	}
+
+	var err error
+	if options.minSize != "" {
+		if f.minSize, err = parseSize(options.minSize); err != nil {
+			return nil, err
+		}
+	}
+	if options.maxSize != "" {
+		if f.maxSize, err = parseSize(options.maxSize); err != nil {
+			return nil, err
+		}
+	}
+	if options.newerThan != "" {
+		if f.newerThan, err = parseAge(options.newerThan); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// parsePattern parses glob. Pattern containing slash is matched against path relative to root, otherwise
+// against file name at any depth. Trailing slash only matches folders and ** matches any number of folders.
+func parsePattern(expr string) (pattern, error) {
+	var p pattern
+	if strings.HasSuffix(expr, "/") {
+		p.dirOnly = true
+		expr = strings.TrimRight(expr, "/")
+	}
+	if strings.Contains(expr, "/") {
+		p.anchored = true
+		expr = strings.TrimPrefix(expr, "/")
+	}
+	if expr == "" {
+		return p, errors.New("empty filter pattern")
+	}
+	p.segments = strings.Split(expr, "/")
+	for _, segment := range p.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return p, errors.New("invalid filter pattern: " + expr)
+		}
+	}
+	return p, nil
+}
+
+// readPatternFile returns patterns listed in file, skipping blank lines and comments
+func readPatternFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseSize parses size in bytes with optional K, M, G or T suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	if number != "" {
+		if unit := strings.IndexByte("KMGT", number[len(number)-1]); unit >= 0 {
+			multiplier = int64(1) << (10 * (unit + 1))
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size: " + value)
+	}
+	return size * multiplier, nil
+}
+
+// parseAge returns cutoff time given either as age such as 36h or 7d, or as date in YYYY-MM-DD or RFC 3339 format
+func parseAge(value string) (time.Time, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-age), nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	return time.Time{}, errors.New("invalid age or date: " + value)
+}
+
+// match returns true if pattern matches given relative path
+func (p *pattern) match(name string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	target := strings.Split(name, "/")
+	if !p.anchored {
+		target = target[len(target)-1:]
+	}
+	return matchSegments(p.segments, target)
+}
+
+// matchSegments matches path segments one by one with ** matching any number of them
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// loadIgnoreRules adds rules from ignore files in given folder to rules of its parents
+func (f *fileFilter) loadIgnoreRules(root, dir string, rules []ignoreRule) []ignoreRule {
+	// Don't let siblings share backing array.
+	rules = rules[:len(rules):len(rules)]
+	for _, name := range f.ignoreFiles {
+		lines, err := readPatternFile(filepath.Join(root, filepath.FromSlash(dir), name))
+		if err != nil {
+			continue
+		}
+		for _, line := range lines {
+			negate := strings.HasPrefix(line, "!")
+			// Backslash escapes leading # or !.
+			p, err := parsePattern(strings.TrimPrefix(strings.TrimPrefix(line, "!"), "\\"))
+			if err != nil {
+				continue
+			}
+			p.negate = negate
+			rules = append(rules, ignoreRule{base: dir, pattern: p})
+		}
+	}
+	return rules
+}
+
+// ignored returns true if path is excluded on command line or by ignore files. Last matching ignore rule wins.
+func (f *fileFilter) ignored(name string, dir bool, rules []ignoreRule) bool {
+	for _, p := range f.excludes {
+		if p.match(name, dir) {
+			return true
+		}
+	}
+	ignored := false
+	for _, rule := range rules {
+		relative := name
+		if rule.base != "" {
+			if !strings.HasPrefix(name, rule.base+"/") {
+				continue
+			}
+			relative = name[len(rule.base)+1:]
+		}
+		if rule.match(relative, dir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// accepts returns true if file with given relative path, size and modification time passes filter.
+// Folders leading to file are expected to have been checked already.
+func (f *fileFilter) accepts(name string, size int64, modTime time.Time, rules []ignoreRule) bool {
+	if f.ignored(name, false, rules) {
+		return false
+	}
+	if len(f.includes) > 0 {
+		included := false
+		for _, p := range f.includes {
+			if p.match(name, false) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	if size < f.minSize || (f.maxSize > 0 && size > f.maxSize) {
+		return false
+	}
+	return f.newerThan.IsZero() || modTime.After(f.newerThan)
+}
+
+// Walk returns paths of all files under root which pass filter. Excluded folders are not descended into.
+func (f *fileFilter) Walk(root string) []string {
+	return f.walk(root, "", nil)
+}
+
+// walk collects files from folder with given path relative to root
+func (f *fileFilter) walk(root, dir string, rules []ignoreRule) []string {
+	rules = f.loadIgnoreRules(root, dir, rules)
+	files := make([]string, 0)
+	entries, _ := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if !f.ignored(name, true, rules) {
+				files = append(files, f.walk(root, name, rules)...)
+			}
+			continue
+		}
+		completePath := root + string(os.PathSeparator) + filepath.FromSlash(name)
+		if info, err := os.Stat(completePath); err == nil && f.accepts(name, info.Size(), info.ModTime(), rules) {
+			files = append(files, completePath)
+		}
+	}
+	return files
+}
+
+// Matches returns true if file with given relative path would have been found by Walk had it existed
+// locally. Used for files which only exist on server.
+func (f *fileFilter) Matches(root, name string, size int64, modTime time.Time) bool {
+	segments := strings.Split(name, "/")
+	rules := f.loadIgnoreRules(root, "", nil)
+	for i := 1; i < len(segments); i++ {
+		dir := strings.Join(segments[:i], "/")
+		if f.ignored(dir, true, rules) {
+			return false
+		}
+		rules = f.loadIgnoreRules(root, dir, rules)
+	}
+	return f.accepts(name, size, modTime, rules)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"10K", 10 * 1024, false},
+		{"10kb", 10 * 1024, false},
+		{"2M", 2 << 20, false},
+		{"2G", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"-1", 0, true},
+		{"1.5M", 0, true},
+		{"10X", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			size, err := parseSize(test.value)
+			if (err != nil) != test.err || size != test.want {
+				t.Errorf("parseSize(%q) = %d, %v", test.value, size, err)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"36h", now.Add(-36 * time.Hour), false},
+		{"7d", now.AddDate(0, 0, -7), false},
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), false},
+		{"2024-01-02T03:04:05Z", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"-1d", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			cutoff, err := parseAge(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("parseAge(%q) error %v", test.value, err)
+			}
+			if diff := cutoff.Sub(test.want); diff < -time.Minute || diff > time.Minute {
+				t.Errorf("parseAge(%q) = %v, want %v", test.value, cutoff, test.want)
+			}
+		})
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		dir     bool
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", false, true},
+		{"*.tmp", "deep/in/tree/a.tmp", false, true},
+		{"*.tmp", "a.txt", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"src/*.go", "src/main.go", false, true},
+		{"src/*.go", "other/src/main.go", false, false},
+		{"/src/*.go", "src/main.go", false, true},
+		{"src/**", "src/a/b/c.go", false, true},
+		{"src/**/*.go", "src/main.go", false, true},
+		{"src/**/*.go", "src/a/b/main.go", false, true},
+		{"**/test/*", "a/b/test/x", false, true},
+		{"**/test/*", "test/x", false, true},
+		{"**/test/*", "a/test/b/x", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.name, func(t *testing.T) {
+			p, err := parsePattern(test.pattern)
+			if err != nil {
+				t.Fatalf("parsePattern: %v", err)
+			}
+			if got := p.match(test.name, test.dir); got != test.want {
+				t.Errorf("match = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterWalk(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().AddDate(0, 0, -30)
+	files := map[string]int{
+		"a.txt":            10,
+		"b.tmp":            10,
+		"big.bin":          5000,
+		"old.txt":          10,
+		"src/main.go":      100,
+		"src/main_test.go": 100,
+		"src/gen/out.go":   100,
+		"build/app":        100,
+		"docs/keep.md":     10,
+		"docs/skip.md":     10,
+	}
+	for name, size := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, make([]byte, size), 0644)
+	}
+	os.Chtimes(filepath.Join(root, "old.txt"), old, old)
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("build/\n"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", ".gfcignore"), []byte("*.md\n!keep.md\n"), 0644)
+	os.WriteFile(filepath.Join(root, "excludes"), []byte("# comment\n\n*_test.go\n"), 0644)
+
+	all := []string{".gitignore", "a.txt", "b.tmp", "big.bin", "build/app", "docs/keep.md", "excludes", "old.txt",
+		"src/gen/out.go", "src/main.go", "src/main_test.go"}
+
+	tests := []struct {
+		name    string
+		options filterOptions
+		want    []string
+	}{
+		{"no filters", filterOptions{}, all},
+		{"exclude", filterOptions{excludes: []string{"*.tmp", "src/gen/"}},
+			without(all, "b.tmp", "src/gen/out.go")},
+		{"include", filterOptions{includes: []string{"src/**/*.go"}},
+			[]string{"src/gen/out.go", "src/main.go", "src/main_test.go"}},
+		{"exclude wins over include", filterOptions{includes: []string{"*.go"}, excludes: []string{"gen/"}},
+			[]string{"src/main.go", "src/main_test.go"}},
+		{"exclude from file", filterOptions{excludeFrom: []string{filepath.Join(root, "excludes")}},
+			without(all, "src/main_test.go")},
+		{"size", filterOptions{minSize: "50", maxSize: "1K"},
+			[]string{"build/app", "src/gen/out.go", "src/main.go", "src/main_test.go"}},
+		{"newer than", filterOptions{newerThan: "7d"}, without(all, "old.txt")},
+		{"gitignore", filterOptions{gitignore: true}, without(all, "build/app")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newFileFilter(test.options)
+			if err != nil {
+				t.Fatalf("newFileFilter: %v", err)
+			}
+			var got []string
+			for _, path := range filter.Walk(root) {
+				relative, _ := filepath.Rel(root, path)
+				if name := filepath.ToSlash(relative); name != "docs/.gfcignore" {
+					got = append(got, name)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Walk = %v, want %v", got, test.want)
+			}
+
+			// Files only on server are matched the same way.
+			for _, name := range test.want {
+				if !filter.Matches(root, name, int64(files[name]), time.Now()) {
+					t.Errorf("Matches(%q) = false for file Walk found", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterMatchesExcludedFolder(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".gfcignore"), []byte("cache/\n"), 0644)
+	filter, err := newFileFilter(filterOptions{excludes: []string{"*.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"data/file", true},
+		{"cache/file", false},
+		{"data/cache/file", false},
+		{"data/app.log", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := filter.Matches(root, test.name, 10, time.Now()); got != test.want {
+				t.Errorf("Matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		options filterOptions
+	}{
+		{"size", filterOptions{minSize: "lots"}},
+		{"age", filterOptions{newerThan: "soon"}},
+		{"exclude file", filterOptions{excludeFrom: []string{filepath.Join(t.TempDir(), "missing")}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newFileFilter(test.options); err == nil {
+				t.Errorf("invalid filter was accepted")
+			}
+		})
+	}
+}
+
+// without returns names except given ones
+func without(names []string, except ...string) []string {
+	return slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+		return slices.Contains(except, name)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"go_fast_copy/client/comms"
@@ -8,6 +9,7 @@ import (
 	"go_fast_copy/constants"
 	"go_fast_copy/fileio"
 	"go_fast_copy/networking"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime/debug"
@@ -19,23 +21,71 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		// Compare file with copy on server instead of sending it.
+		verify(os.Args[1:])
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		// Decrypt file sent with end-to-end encryption.
+		decrypt(os.Args[1:])
+		return
+	}
+
 	args := argparse.NewParser("client", constants.Title)
 
 	bind := args.String("a", "address", &argparse.Options{Required: true, Help: "Target host address"})
+	checksum := args.Flag("C", "checksum", &argparse.Options{Help: "Skip identical files by comparing checksum. Without it files with same size and modification time are skipped unless -o or --force is used"})
+	force := args.Flag("F", "force", &argparse.Options{Help: "Send every file even if identical file exists on server"})
 	chunk := args.Int("c", "chunksize", &argparse.Options{Required: false, Help: "File I/O chunk size in KB " +
 		"(" + strconv.Itoa(constants.MIN_CLIENT_CHUNK_SIZE) + "-" +
 		strconv.Itoa(constants.MAX_CLIENT_CHUNK_SIZE) + ")", Default: constants.DEFAULT_FILE_CHUNK_SIZE})
 	dscp := args.Int("d", "dscp", &argparse.Options{Required: false, Help: "DSCP field for QoS",
 		Default: constants.DEFAULT_DSCP})
+	dictionary := args.String("D", "dictionary", &argparse.Options{Required: false,
+		Help: "Use file contents as LZ4 compression dictionary (up to " +
+			strconv.Itoa(constants.MAX_DICTIONARY_SIZE) + "KB)"})
 	file := args.String("f", "file", &argparse.Options{Required: false, Help: "File path"})
+	dest := args.String("", "dest", &argparse.Options{Help: "Destination under root of server. Folder if it ends with slash " +
+		"or when sending multiple files, otherwise new name of file"})
+	filesFrom := args.String("", "files-from", &argparse.Options{Help: "Read list of files to send from file, or standard input if -. " +
+		"Each entry may be followed by tab and name on server"})
+	name := args.String("", "name", &argparse.Options{Help: "Name of file on server when reading it from standard input with -f -"})
+	tarFile := args.String("", "tar", &argparse.Options{Help: "Send every file in tar archive, or archive read from standard input if -, " +
+		"as separate file"})
+	null := args.Flag("0", "null", &argparse.Options{Help: "Entries of file list are separated by null characters instead of newlines"})
+	integrity := args.Flag("i", "integrity", &argparse.Options{Help: "Send checksum with every chunk so corrupted ones can be sent again"})
 	pass := args.String("k", "key", &argparse.Options{Required: false, Help: "Encryption key (16 or 32 characters). Enables AES 128 or 256 encryption"})
+	level := args.Int("l", "level", &argparse.Options{Required: false, Help: "LZ4 compression level " +
+		"(0 for fast, 1-" + strconv.Itoa(constants.MAX_COMPRESSION_LEVEL) + " for high compression)", Default: 0})
 	mptcp := args.Flag("m", "mptcp", &argparse.Options{Help: "Enable Multipath TCP"})
+	output := args.Selector("O", "output", []string{"text", "json"}, &argparse.Options{Required: false,
+		Help: "Output format: text, or JSON events of transfers or JSON comparison report with --compare", Default: "text"})
 	omit := args.Flag("o", "omit", &argparse.Options{Help: "Omit checksum calculation"})
 	port := args.Int("p", "port", &argparse.Options{Required: false, Help: "Target port",
 		Default: constants.DEFAULT_PORT})
+	repair := args.Flag("R", "repair", &argparse.Options{Help: "Build hash tree of files so only corrupted blocks are sent again on checksum mismatch"})
 	recursive := args.String("r", "recursive", &argparse.Options{Required: false,
 		Help: "Recursively send all the files under given path"})
 	sha := args.Flag("s", "sha", &argparse.Options{Help: "Use SHA256 checksum instead of CRC32"})
+	hashName := args.Selector("H", "hash", fileio.HashNames(), &argparse.Options{Required: false,
+		Help: "Checksum algorithm (" + strings.Join(fileio.HashNames(), ", ") + ")"})
+	dryRun := args.Flag("n", "dry-run", &argparse.Options{Help: "Only list which files would be sent and which skipped"})
+	train := args.Flag("T", "train", &argparse.Options{Help: "Train LZ4 compression dictionary from files being sent"})
+	delta := args.Flag("x", "delta", &argparse.Options{Help: "Only send what differs if server has older version of file"})
+	dedup := args.Flag("u", "dedup", &argparse.Options{Help: "Cut files at content-defined boundaries and only send chunks server does not already have"})
+	compare := args.Flag("", "compare", &argparse.Options{Help: "Compare files with the ones on server without transferring anything"})
+	includes := args.StringList("", "include", &argparse.Options{Help: "Only send files matching glob in recursive mode (repeatable)"})
+	excludes := args.StringList("", "exclude", &argparse.Options{Help: "Skip files and folders matching glob in recursive mode (repeatable)"})
+	excludeFrom := args.StringList("", "exclude-from", &argparse.Options{Help: "Read exclude globs from file, one per line (repeatable)"})
+	minSize := args.String("", "min-size", &argparse.Options{Help: "Skip files smaller than given size, e.g. 10K"})
+	maxSize := args.String("", "max-size", &argparse.Options{Help: "Skip files larger than given size, e.g. 2G"})
+	newerThan := args.String("", "newer-than", &argparse.Options{Help: "Only send files modified within given age (e.g. 36h, 7d) or after given date (YYYY-MM-DD)"})
+	gitignore := args.Flag("", "gitignore", &argparse.Options{Help: "Skip files listed in .gitignore files in addition to .gfcignore files"})
+	e2eKeyFile := args.String("", "e2e-key", &argparse.Options{Help: "Encrypt file contents with 256-bit key read from given file " +
+		"(32 bytes or 64 hex characters) so server never sees them"})
+	encryptNames := args.Flag("", "encrypt-names", &argparse.Options{Help: "Encrypt file and folder names with end-to-end key too"})
+	bwlimit := args.String("", "bwlimit", &argparse.Options{Help: "Limit bandwidth to given bytes per second, e.g. 10M. " +
+		"Comma separated rates may apply during time of day, e.g. 08:00-18:00=2M,20M"})
 	workers := args.Int("t", "threads", &argparse.Options{Required: false, Help: "Number of compression (and encryption) threads",
 		Default: constants.DEFAULT_NUM_WORKERS * 2})
 
@@ -43,40 +93,214 @@ func main() {
 
 	if err != nil {
 		fmt.Print(args.Usage(err))
-		os.Exit(1)
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	// Keep standard output for machine-readable report only.
+	report := os.Stdout
+	var events *eventLog
+	if *output == "json" {
+		os.Stdout = os.Stderr
+		if !*compare {
+			// Transfers are reported as events instead.
+			events = newEventLog(report)
+		}
 	}
 
 	if *pass != "" {
 		if !(len(*pass) == 32) && !(len(*pass) == 16) {
 			fmt.Println("Key length must be 16 or 32 bytes")
-			os.Exit(1)
+			events.Exit(constants.EXIT_ERROR)
+		}
+	}
+
+	if *level < 0 || *level > constants.MAX_COMPRESSION_LEVEL {
+		fmt.Println("Compression level must be between 0 and " + strconv.Itoa(constants.MAX_COMPRESSION_LEVEL))
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *compare && *omit {
+		fmt.Println("Comparison requires checksums. Please do not use -o with --compare.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *force && *checksum {
+		fmt.Println("Please use either -C to skip identical files or --force to send every file, not both.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *dictionary != "" && *train {
+		fmt.Println("Please use either -D or -T to provide dictionary, not both.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *file != "" && *filesFrom != "" {
+		fmt.Println("Please use either -f or --files-from, not both.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *tarFile != "" && (*file != "" || *recursive != "" || *filesFrom != "") {
+		fmt.Println("Please use --tar on its own, not with -f, -r or --files-from.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	filtered := len(*includes) > 0 || len(*excludes) > 0 || len(*excludeFrom) > 0 || *minSize != "" || *maxSize != "" ||
+		*newerThan != "" || *gitignore
+	if filtered && (*file != "" || *filesFrom != "" || *tarFile != "") {
+		// Files listed explicitly are always sent.
+		fmt.Println("Filters only apply to contents of folder. Please do not use --include, --exclude, --exclude-from, --min-size, --max-size, --newer-than or --gitignore with -f, --files-from or --tar.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *file == "-" && *name == "" {
+		fmt.Println("Please use --name to provide name of file on server when reading from standard input.")
+		events.Exit(constants.EXIT_ERROR)
+	}
+
+	if *file == "-" || *tarFile != "" {
+		if *checksum || *delta || *dedup || *repair || *train || *compare || *dryRun {
+			fmt.Println("Streams can only be read once. Please do not use -C, -x, -u, -R, -T, --compare or --dry-run with -f - or --tar.")
+			events.Exit(constants.EXIT_ERROR)
+		}
+	}
+
+	var limiter *networking.RateLimiter
+
+	if *bwlimit != "" {
+		if limiter, err = networking.NewRateLimiter(*bwlimit); err != nil {
+			fmt.Println("Invalid bandwidth limit:", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+	}
+
+	var e2eKey []byte
+	var names *fileio.NameCipher
+
+	if *e2eKeyFile != "" {
+		if *checksum || *delta || *dedup || *repair || *compare || *dictionary != "" || *train {
+			fmt.Println("Server can't compare, patch or decompress encrypted files. Please do not use -C, -x, -u, -R, -D, -T or --compare with --e2e-key.")
+			events.Exit(constants.EXIT_ERROR)
+		}
+		if *file == "-" {
+			// Size of original contents is part of encrypted file header and has to be known up front.
+			fmt.Println("Size of standard input is not known in advance. Please do not use -f - with --e2e-key.")
+			events.Exit(constants.EXIT_ERROR)
 		}
+		if e2eKey, err = fileio.LoadKey(*e2eKeyFile); err != nil {
+			fmt.Println("Could not load end-to-end key -", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+		if *encryptNames {
+			names, _ = fileio.NewNameCipher(e2eKey)
+		}
+	} else if *encryptNames {
+		fmt.Println("Please use --e2e-key to provide key for encrypting names.")
+		events.Exit(constants.EXIT_ERROR)
 	}
 
 	var path string
 
-	if *file != "" {
+	if *file == "-" {
+		path = *file
+	} else if *file != "" {
 		path = filepath.Clean(*file)
 	} else if *recursive != "" {
 		path = filepath.Clean(strings.ReplaceAll(*recursive, "\"", ""))
+	} else if *filesFrom != "" {
+		path = "."
+	} else if *tarFile != "" {
+		path = filepath.Clean(*tarFile)
 	} else {
-		fmt.Println("Nothing to do. Please use either -f or -r to provide file or folder.")
-		os.Exit(0)
+		fmt.Println("Nothing to do. Please use either -f, -r, --files-from or --tar to provide file, folder, list of files or archive.")
+		events.Exit(constants.EXIT_ERROR)
 	}
 
-	// Get file info.
-	finfo, err := os.Stat(path)
-	if err != nil {
-		fmt.Println("Can't open path:", err.Error())
-		os.Exit(1)
+	if path != "-" {
+		// Get file info.
+		finfo, err := os.Stat(path)
+		if err != nil {
+			fmt.Println("Can't open path:", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+
+		// Do nothing if it's a folder.
+		if finfo.IsDir() {
+			if *recursive == "" && *filesFrom == "" {
+				fmt.Println("Provided path is directory. Please use -r to send contents of directory.")
+				events.Exit(constants.EXIT_ERROR)
+			}
+		}
 	}
 
-	// Do nothing if it's a folder.
-	if finfo.IsDir() {
-		if *recursive == "" {
-			fmt.Println("Provided path is directory. Please use -r to send contents of directory.")
-			os.Exit(0)
+	var entries []fileEntry
+	var filter *fileFilter
+	var archive io.Reader
+
+	// Root folder of files when sending contents of folder.
+	rootdir := ""
+
+	if *filesFrom != "" {
+		// Paths in list are relative to folder given with -r.
+		entries, err = readFileList(*filesFrom, path, *null)
+		if err != nil {
+			fmt.Println("Can't read file list:", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+	} else if *recursive != "" {
+		filter, err = newFileFilter(filterOptions{
+			includes:    *includes,
+			excludes:    *excludes,
+			excludeFrom: *excludeFrom,
+			minSize:     *minSize,
+			maxSize:     *maxSize,
+			newerThan:   *newerThan,
+			gitignore:   *gitignore,
+		})
+		if err != nil {
+			fmt.Println("Invalid filter:", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+		rootdir = path
+		entries = listEntries(rootdir, filter.Walk(path))
+	} else if *tarFile != "" {
+		// Members are read from archive while sending.
+		archive = os.Stdin
+		if path != "-" {
+			if archive, err = os.Open(path); err != nil {
+				fmt.Println("Can't open archive:", err.Error())
+				events.Exit(constants.EXIT_ERROR)
+			}
+		}
+	} else if path == "-" {
+		remote, err := destinationName(*name, "")
+		if err != nil || strings.HasSuffix(*name, "/") {
+			fmt.Println("Invalid name:", *name)
+			events.Exit(constants.EXIT_ERROR)
 		}
+		entries = []fileEntry{stdinEntry(remote)}
+	} else {
+		entries = listEntries("", []string{path})
+	}
+
+	if *dest != "" {
+		if err = withDestination(entries, *dest, *file != ""); err != nil {
+			fmt.Println(err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+	}
+
+	compression := &fileio.CompressionOptions{Level: *level}
+
+	if *dictionary != "" {
+		compression.Dictionary, err = fileio.LoadDictionary(*dictionary)
+		if err != nil {
+			fmt.Println("Can't load dictionary:", err.Error())
+			events.Exit(constants.EXIT_ERROR)
+		}
+	} else if *train {
+		samples := fileio.SampleFiles(entryPaths(entries), constants.DICTIONARY_SAMPLE_SIZE*1024, constants.DICTIONARY_MAX_SAMPLES)
+		compression.Dictionary = fileio.TrainDictionary(samples, constants.MAX_DICTIONARY_SIZE*1024)
+		fmt.Println("Trained", len(compression.Dictionary), "byte dictionary from", len(samples), "samples")
 	}
 
 	debug.SetGCPercent(666)
@@ -84,6 +308,7 @@ func main() {
 	addr := *bind + ":" + strconv.Itoa(*port)
 
 	comms := new(comms.Client)
+	comms.OnLost(events.Exit)
 
 	// Connect to host.
 	err = comms.Connect(addr, *dscp, *mptcp)
@@ -98,9 +323,36 @@ func main() {
 		crypto, err := comms.Authenticate(*pass, nonce)
 		if err != nil {
 			fmt.Println(err.Error())
-			os.Exit(1)
+			events.Exit(constants.EXIT_ERROR)
 		}
 		fmt.Println("Handshake ok")
+		events.Emit("connected", eventFields{"address": addr})
+		comms.UseRateLimit(limiter)
+
+		if len(compression.Dictionary) > 0 {
+			if !comms.SupportsCodec(constants.CODEC_LZ4_DICT) || !comms.SendDictionary(compression.Dictionary) {
+				fmt.Println("Server did not accept dictionary. Compressing without one.")
+				compression.Dictionary = nil
+			}
+		}
+
+		var algorithm uint8 = constants.HASH_CRC32
+		if *sha {
+			algorithm = constants.HASH_SHA256
+		}
+		if *hashName != "" {
+			algorithm, _ = fileio.HashByName(*hashName)
+		}
+		if *omit {
+			algorithm = constants.HASH_NONE
+		} else if !comms.SupportsHash(algorithm) {
+			fmt.Println("Server does not support", fileio.HashName(algorithm), "checksums. Using crc32 instead.")
+			algorithm = constants.HASH_CRC32
+		}
+
+		if *integrity {
+			comms.UseRetransmit()
+		}
 
 		// 8MB chunks the limit.
 		if *chunk > constants.MAX_CLIENT_CHUNK_SIZE {
@@ -112,114 +364,351 @@ func main() {
 			fmt.Println("Chunk size below minimum. Using " + strconv.Itoa(*chunk))
 		}
 
-		if *recursive != "" {
+		if *compare {
+			// Files on server outside destination folder are not compared.
+			destination := ""
+			if *dest != "" && rootdir != "" {
+				folder, _ := destinationName(*dest+"/", "")
+				destination = filepath.ToSlash(folder)
+			}
+			result := compareFiles(comms, rootdir, destination, entries, algorithm, filter)
+			comms.Close()
+			result.Print(report, *output == "json")
+			if !result.Matches() {
+				events.Exit(constants.EXIT_MISMATCH)
+			}
+			return
+		}
+
+		options := &transferOptions{
+			workers:     *workers,
+			chunk:       *chunk,
+			crypto:      crypto,
+			compression: compression,
+			omit:        *omit,
+			algorithm:   algorithm,
+			checksum:    *checksum,
+			force:       *force,
+			delta:       *delta,
+			dedup:       *dedup,
+			integrity:   *integrity,
+			repair:      *repair,
+			e2eKey:      e2eKey,
+			names:       names,
+			progress:    newProgressBar(entriesSize(entries), events),
+			events:      events,
+		}
+
+		if *dryRun {
+			var sendCount, skipCount int
+			var sendBytes, skipBytes int64
+			for _, entry := range entries {
+				send, size := probeFile(comms, options, entry)
+				if send {
+					sendCount++
+					sendBytes += size
+				} else {
+					skipCount++
+					skipBytes += size
+				}
+			}
+			fmt.Println("Would send", sendCount, "files ("+strconv.FormatInt(sendBytes, 10)+" bytes) and skip",
+				skipCount, "files ("+strconv.FormatInt(skipBytes, 10)+" bytes)")
+			comms.Close()
+			events.Summary(constants.EXIT_OK)
+			return
+		}
+
+		if *tarFile != "" {
+			count := sendArchive(comms, options, archive, *dest)
+			fmt.Println("Processed", count, "files in total")
+		} else if *recursive != "" || *filesFrom != "" {
 			var count int
-			// Recursively send all contents of a folder.
-			for _, file := range recursiveFileTree(path) {
-				transferFile(comms, *workers, *chunk, path, file, crypto, *omit, *sha)
+			// Send all contents of a folder or all listed files.
+			for _, entry := range entries {
+				transferFile(comms, options, entry)
 				count += 1
 				fmt.Println()
 			}
 			fmt.Println("Processed", count, "files in total")
 		} else {
 			// Send single file.
-			transferFile(comms, *workers, *chunk, "", path, crypto, *omit, *sha)
+			transferFile(comms, options, entries[0])
 		}
 
 		// Close connection.
 		comms.Close()
 		fmt.Println("Disconnected")
+		events.Summary(constants.EXIT_OK)
 	} else {
 		fmt.Println(err.Error())
-		os.Exit(1)
+		events.Exit(constants.EXIT_ERROR)
 	}
 }
 
-// recursiveFileTree will recursively traverse entire file tree of given root path and return list of all paths
-func recursiveFileTree(root string) []string {
-	files := make([]string, 0)
-	entries, _ := os.ReadDir(root)
-	for _, entry := range entries {
-		if entry.IsDir() {
-			files = append(files, recursiveFileTree(root+string(os.PathSeparator)+entry.Name())...)
-		} else {
-			completePath := root + string(os.PathSeparator) + entry.Name()
-			if _, err := os.Stat(completePath); err == nil {
-				files = append(files, completePath)
-			}
-		}
+// transferOptions holds settings applied to every file transfer
+type transferOptions struct {
+	workers     int
+	chunk       int
+	crypto      *networking.Crypto
+	compression *fileio.CompressionOptions
+	omit        bool               // Omit checksum calculation
+	algorithm   uint8              // Checksum algorithm
+	checksum    bool               // Skip identical files by checksum instead of size and modification time
+	force       bool               // Send files even if identical file exists on server
+	delta       bool               // Only send what differs from existing file
+	dedup       bool               // Only send chunks missing from chunk store
+	integrity   bool               // Send checksum with every chunk
+	repair      bool               // Only send corrupted blocks again on checksum mismatch
+	e2eKey      []byte             // Contents are encrypted with this key before sending if set
+	names       *fileio.NameCipher // Names on server are encrypted if set
+	progress    *progressBar       // Progress is shown if set
+	events      *eventLog          // Transfers are reported as JSON events if set
+}
+
+// remoteName returns name of file on server
+func remoteName(options *transferOptions, entry fileEntry) string {
+	if options.names != nil {
+		return options.names.Encrypt(entry.name)
 	}
-	return files
+	return entry.name
 }
 
-// transferFile sends all contents of given file
-func transferFile(comms *comms.Client, workers, chunk int, rootdir, fileName string,
-	crypto *networking.Crypto, omit, sha bool) {
+// requestSkip asks server to skip file with same size and modification time as identical, unless checksums are
+// compared instead or every file is sent. Without checksum there would be nothing to catch changed contents.
+func requestSkip(options *transferOptions, records map[string]string) {
+	if options.algorithm > 0 && !options.checksum && !options.force {
+		records[constants.PAXSkip] = "1"
+	}
+}
+
+// probeFile asks server whether it would accept file without sending it. Returns true and file size if it would.
+func probeFile(comms *comms.Client, options *transferOptions, entry fileEntry) (bool, int64) {
+	fileName := entry.path
+	info, err := os.Stat(fileName)
+	if err != nil {
+		fmt.Println(err.Error())
+		options.events.Exit(constants.EXIT_ERROR)
+	}
+
+	var hash []byte
+	if options.algorithm > 0 && options.checksum {
+		hash = fileio.GetFileChecksum(fileName, options.algorithm)
+	}
 
+	// Server does not prepare to receive the file.
+	records := map[string]string{constants.PAXProbe: "1"}
+	requestSkip(options, records)
+
+	switch comms.Initiate(remoteName(options, entry), info, hash, options.algorithm, records) {
+	case 1:
+		fmt.Println("Would send:", fileName, "("+strconv.FormatInt(info.Size(), 10)+" bytes)")
+		options.events.File("file_would_send", entry, uint64(info.Size()), nil)
+		return true, info.Size()
+	case 2:
+		fmt.Println("Would skip:", fileName, "(identical file exists on server)")
+		options.events.File("file_would_skip", entry, uint64(info.Size()), eventFields{"reason": "identical"})
+		return false, info.Size()
+	default:
+		fmt.Println("Server would not accept", fileName)
+		options.events.File("file_failed", entry, uint64(info.Size()), eventFields{"reason": "rejected"})
+		options.events.Exit(constants.EXIT_ERROR)
+	}
+	return false, 0
+}
+
+// transferFile sends all contents of given file
+func transferFile(comms *comms.Client, options *transferOptions, entry fileEntry) {
+	fileName := entry.path
+	var factory fileio.IOFactory = new(fileio.BufferedFactory)
+	if entry.source != nil {
+		// Data is read from stream such as standard input instead of file.
+		factory = &fileio.StreamFactory{Source: entry.source}
+	}
+	readHash := options.algorithm
+	if options.e2eKey != nil {
+		// Checksum is calculated over encrypted contents instead.
+		readHash = constants.HASH_NONE
+	}
 	worker := new(worker.CompressingReader)
-	err := worker.StartFileReader(new(fileio.BufferedFactory), fileName, workers, chunk)
+	err := worker.StartFileReader(factory, fileName, options.workers, options.chunk, readHash)
 
 	if err == nil {
 		fmt.Print("Starting file transfer for '", fileName, "' ")
 
+		info, err := statEntry(entry)
+		if err != nil {
+			fmt.Println(err.Error())
+			options.events.Exit(constants.EXIT_ERROR)
+		}
+		defer options.progress.Done(uint64(info.Size()))
+		options.events.File("file_started", entry, uint64(info.Size()), nil)
+
 		var hash []byte
-		var method uint8
+		method := options.algorithm
 
-		if !omit {
-			if sha {
-				method = 2
-				hash = fileio.GetFileChecksumSHA256(fileName)
-			} else {
-				method = 1
-				hash = fileio.GetFileChecksumCRC32(fileName)
-			}
+		if method > 0 && options.checksum {
+			// Server compares contents instead of size and modification time. Requires reading file twice.
+			hash = fileio.GetFileChecksum(fileName, method)
 			fmt.Println("[Checksum:", hex.EncodeToString(hash)+"]")
+		} else {
+			fmt.Println()
+		}
+
+		records := make(map[string]string)
+		for key, value := range entry.records {
+			records[key] = value
+		}
+		requestSkip(options, records)
+		if options.delta {
+			// Ask for block signatures if server already has a different version of the file.
+			records[constants.PAXDelta] = "1"
+		}
+		if options.dedup {
+			// Ask to only send chunks server does not already have.
+			records[constants.PAXDedup] = "1"
+		}
+		if options.repair && method > 0 {
+			// Ask server to build hash tree so only corrupted blocks need to be sent again.
+			records[constants.PAXTree] = "1"
+		}
+		if options.e2eKey != nil {
+			// Server can only tell size of original contents from header.
+			records[constants.PAXSealed] = "1"
 		}
 
 		// Request file transfer.
-		status := comms.Initiate(rootdir, fileName, hash, method)
+		status := comms.Initiate(remoteName(options, entry), info, hash, method, records)
+
+		var manifestHash []byte
 
 		switch status {
 		case 0:
 			fmt.Println("Server not ready to receive the file")
-			os.Exit(1)
+			options.events.File("file_failed", entry, uint64(info.Size()), eventFields{"reason": "not_ready"})
+			options.events.Exit(constants.EXIT_ERROR)
 		case 1:
 			fmt.Println("Server is ready to accept the file")
 		case 2:
 			fmt.Println("Server already has identical file. Omitting!")
+			options.events.File("file_skipped", entry, uint64(info.Size()), eventFields{"reason": "identical"})
 			return
+		case 4:
+			sigs := comms.ReadSignatures()
+			if sigs == nil {
+				fmt.Println("Could not receive block signatures from server")
+				options.events.Exit(constants.EXIT_ERROR)
+			}
+			fmt.Println("Server has different version of the file. Sending only what differs")
+			worker.UseDelta(sigs)
+		case 5:
+			entries, err := fileio.GetFileManifest(fileName, options.chunk*1024)
+			if err != nil {
+				fmt.Println(err.Error())
+				options.events.Exit(constants.EXIT_ERROR)
+			}
+			hashes := make([][32]byte, len(entries))
+			manifest := new(bytes.Buffer)
+			for i, entry := range entries {
+				hashes[i] = entry.Hash
+				manifest.Write(fileio.EncodeEntry(entry))
+			}
+			present := comms.QueryChunks(hashes)
+			if present == nil {
+				fmt.Println("Could not query chunks from server")
+				options.events.Exit(constants.EXIT_ERROR)
+			}
+			var reused int
+			for _, entry := range entries {
+				if present[entry.Hash] {
+					reused++
+				}
+			}
+			fmt.Println("Server stores files deduplicated and already has", reused, "of", len(entries), "chunks")
+			worker.UseDedup(present)
+			// Server verifies manifest it stores instead of file contents.
+			manifestHash = fileio.GetChecksum(manifest, method)
 		default:
 			fmt.Println("Server did not accept the file")
-			os.Exit(1)
+			options.events.File("file_failed", entry, uint64(info.Size()), eventFields{"reason": "rejected"})
+			options.events.Exit(constants.EXIT_ERROR)
 		}
 
 		begin := time.Now()
 
+		if options.integrity {
+			worker.UseChunkChecksums()
+		}
+		if options.repair && method > 0 && status != 5 {
+			worker.UseTree()
+		}
+		if options.e2eKey != nil {
+			sealer, err := fileio.NewEndToEndSealer(options.e2eKey, info.Size())
+			if err != nil {
+				fmt.Println(err.Error())
+				options.events.Exit(constants.EXIT_ERROR)
+			}
+			worker.UseEndToEnd(sealer, method)
+		}
+
 		// Start sending chunks.
-		channels := worker.StartWorkers(workers, crypto)
+		channels := worker.StartWorkers(options.workers, options.crypto, options.compression)
+		options.progress.Track(entry, uint64(info.Size()), comms.Sent, worker)
 		comms.StartChunkStream(channels)
+		options.progress.Stop()
 
 		comp, total, compStats := worker.GetChunkStats()
 		fmt.Println("Sent all data in",
 			time.Since(begin), "with", comp, "/", total, "chunks compressed")
 		fmt.Println(compStats)
 
+		if method > 0 {
+			// Checksum of everything sent was calculated while reading.
+			hash = worker.Checksum()
+			fmt.Println("[Checksum:", hex.EncodeToString(hash)+"]")
+			if manifestHash != nil {
+				hash = manifestHash
+			}
+		}
+
 		fmt.Println("Waiting for server to confirm")
 		// EOF negotiation with server.
-		ack := comms.EndFileTransfer(fileName, hash, method)
+		ack := comms.EndFileTransfer(fileName, hash, method, worker.Tree())
+
+		size := uint64(info.Size())
+		data, compressed := worker.Progress()
+		if entry.source != nil {
+			// Size of stream is only known once it ends.
+			size = data
+		}
+		result := eventFields{
+			"compressed":  compressed,
+			"duration_ms": time.Since(begin).Milliseconds(),
+			"checksum":    hex.EncodeToString(hash),
+			"hash":        fileio.HashName(method),
+			"verified":    ack,
+		}
 
 		if ack {
 			fmt.Println("Server confirmed file has been synced")
+			options.events.File("file_completed", entry, size, result)
+		} else if comms.Unsent() {
+			fmt.Println("File transfer failed as server could not verify all chunks")
+			result["reason"] = "unsent"
+			options.events.File("file_failed", entry, size, result)
+			options.events.Exit(constants.EXIT_MISMATCH)
 		} else {
-			if omit {
+			if options.omit {
 				fmt.Println("Omitting checksum verification. File integrity unknown.")
+				options.events.File("file_completed", entry, size, result)
 			} else {
 				fmt.Println("File transfer may not have completed or data may be corrupted")
-				os.Exit(2)
+				options.events.File("checksum_mismatch", entry, size, result)
+				options.events.Exit(constants.EXIT_MISMATCH)
 			}
 		}
 	} else {
 		fmt.Println(err.Error())
-		os.Exit(1)
+		options.events.Exit(constants.EXIT_ERROR)
 	}
 }
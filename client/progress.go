@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"go_fast_copy/client/worker"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	progressInterval = 250 * time.Millisecond // How often progress line is redrawn
+	eventInterval    = time.Second            // How often progress event is emitted
+)
+
+// progressBar draws single line of progress of file being sent and all files of session, or emits it as events
+type progressBar struct {
+	total   uint64        // Size of all files, zero if unknown
+	done    uint64        // Size of files already processed
+	sent    uint64        // Data sent of files already processed
+	busy    time.Duration // Time spent sending files already processed
+	start   time.Time     // When sending current file started
+	sentNow func() uint64 // Returns data of current file sent so far
+	events  *eventLog     // Progress is emitted as events instead of drawn if set
+	stop    chan bool
+	stopped chan bool
+}
+
+// progressStats is progress of file being sent at one point
+type progressStats struct {
+	size    uint64  // Size of file
+	sent    uint64  // Data of file sent so far
+	rate    float64 // Current throughput in bytes per second
+	average float64 // Average throughput of session in bytes per second
+	ratio   float64 // Compression ratio so far, zero if unknown
+	eta     time.Duration
+}
+
+// newProgressBar returns progress bar for files of given total size. Progress is emitted to event log if given.
+// Otherwise nil is returned if standard output is not terminal.
+func newProgressBar(total uint64, events *eventLog) *progressBar {
+	if events == nil {
+		info, err := os.Stdout.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return nil
+		}
+	}
+	return &progressBar{total: total, events: events}
+}
+
+// Track keeps reporting progress of file of given size until Stop is called. Amount sent is returned by given
+// function while compression ratio is taken from worker.
+func (p *progressBar) Track(entry fileEntry, size uint64, sentNow func() uint64, reader *worker.CompressingReader) {
+	if p == nil {
+		return
+	}
+	p.start = time.Now()
+	p.sentNow = sentNow
+	p.stop = make(chan bool)
+	p.stopped = make(chan bool)
+
+	interval := progressInterval
+	if p.events != nil {
+		interval = eventInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last, rate float64
+		for {
+			select {
+			case <-p.stop:
+				if p.events == nil {
+					// Clear progress line.
+					fmt.Print("\r\033[K")
+				}
+				close(p.stopped)
+				return
+			case <-ticker.C:
+				sent := sentNow()
+				// Smooth out current throughput over last few updates.
+				current := (float64(sent) - last) / interval.Seconds()
+				rate = 0.7*rate + 0.3*current
+				last = float64(sent)
+				stats := p.stats(size, sent, rate, reader)
+				if p.events != nil {
+					p.events.Progress(entry, p, stats)
+				} else {
+					fmt.Print("\r\033[K" + p.line(entry.path, stats))
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops reporting progress of file being sent
+func (p *progressBar) Stop() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+	p.stop = nil
+	p.sent += p.sentNow()
+	p.busy += time.Since(p.start)
+}
+
+// Done adds size of file which has been processed to overall progress
+func (p *progressBar) Done(size uint64) {
+	if p != nil {
+		p.done += size
+	}
+}
+
+// stats returns progress of file of given size of which given amount has been sent
+func (p *progressBar) stats(size, sent uint64, rate float64, reader *worker.CompressingReader) *progressStats {
+	stats := &progressStats{size: size, sent: sent, rate: rate}
+	stats.average = float64(p.sent+sent) / (p.busy + time.Since(p.start)).Seconds()
+	if data, compressed := reader.Progress(); compressed > 0 {
+		stats.ratio = float64(data) / float64(compressed)
+	}
+
+	remaining := float64(size) - float64(sent)
+	if p.total > 0 {
+		remaining = float64(p.total) - float64(p.done+sent)
+	}
+	if rate > 0 && remaining > 0 {
+		stats.eta = time.Duration(remaining/rate) * time.Second
+	}
+	return stats
+}
+
+// line returns progress line of file with given path
+func (p *progressBar) line(path string, stats *progressStats) string {
+	parts := []string{filepath.Base(path) + " " + progressOf(stats.sent, stats.size)}
+	if p.total > 0 {
+		parts = append(parts, "total "+progressOf(p.done+stats.sent, p.total))
+	}
+	parts = append(parts, worker.HumanReadableSize(uint64(stats.rate))+"/s (avg "+
+		worker.HumanReadableSize(uint64(stats.average))+"/s)")
+	if stats.ratio > 0 {
+		parts = append(parts, fmt.Sprintf("ratio %.2f", stats.ratio))
+	}
+	if stats.eta > 0 {
+		parts = append(parts, "ETA "+stats.eta.String())
+	}
+	return strings.Join(parts, " | ")
+}
+
+// progressOf returns amount done out of total along with percentage if total is known
+func progressOf(done, total uint64) string {
+	if total == 0 {
+		return worker.HumanReadableSize(done)
+	}
+	return fmt.Sprintf("%d%% %s/%s", min(done*100/total, 100), worker.HumanReadableSize(done),
+		worker.HumanReadableSize(total))
+}
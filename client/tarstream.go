@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"go_fast_copy/client/comms"
+	"go_fast_copy/constants"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// sendArchive sends every regular file in tar stream as separate file transfer. Members are placed under
+// destination folder on server if given. Returns number of files sent.
+func sendArchive(comms *comms.Client, options *transferOptions, source io.Reader, dest string) int {
+	var count int
+	tarra := tar.NewReader(source)
+	for {
+		member, err := tarra.Next()
+		if err == io.EOF {
+			return count
+		} else if err != nil {
+			fmt.Println("Can't read archive:", err.Error())
+			options.events.Exit(constants.EXIT_ERROR)
+		}
+
+		if member.Typeflag == tar.TypeDir {
+			// Server creates folders as files are placed in them.
+			continue
+		} else if member.Typeflag != tar.TypeReg {
+			fmt.Println("Skipping", member.Name, "which is not regular file")
+			continue
+		}
+
+		// Like tar, extract absolute paths under root.
+		name := filepath.Clean(filepath.FromSlash(strings.TrimLeft(member.Name, "/")))
+		if !filepath.IsLocal(name) {
+			fmt.Println("Skipping", member.Name, "which is outside root")
+			continue
+		}
+		if dest != "" {
+			if name, err = destinationName(dest+"/", name); err != nil {
+				fmt.Println(err.Error())
+				options.events.Exit(constants.EXIT_ERROR)
+			}
+		}
+
+		transferFile(comms, options, fileEntry{
+			path:    member.Name,
+			name:    name,
+			source:  tarra,
+			info:    member.FileInfo(),
+			records: memberRecords(member),
+		})
+		count += 1
+		fmt.Println()
+	}
+}
+
+// memberRecords returns PAX records of archive member which are carried over to server. Records describing
+// the member itself are already part of tar header sent and transfer related ones can't be overridden.
+func memberRecords(member *tar.Header) map[string]string {
+	records := make(map[string]string)
+	for key, value := range member.PAXRecords {
+		// Standard records have no vendor prefix.
+		if strings.Contains(key, ".") && !strings.HasPrefix(key, "FASTCOPY.") && !strings.HasPrefix(key, "GNU.sparse.") {
+			records[key] = value
+		}
+	}
+	return records
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"go_fast_copy/client/comms"
+	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/akamensky/argparse"
+)
+
+// verify compares local file against copy on server using hash trees without sending file contents
+func verify(arguments []string) {
+	args := argparse.NewParser("client verify", "Compare local file against copy on server")
+
+	bind := args.String("a", "address", &argparse.Options{Required: true, Help: "Target host address"})
+	file := args.String("f", "file", &argparse.Options{Required: true, Help: "File path"})
+	dest := args.String("", "dest", &argparse.Options{Help: "Name of file under root of server if different from local one"})
+	pass := args.String("k", "key", &argparse.Options{Required: false, Help: "Encryption key (16 or 32 characters). Enables AES 128 or 256 encryption"})
+	mptcp := args.Flag("m", "mptcp", &argparse.Options{Help: "Enable Multipath TCP"})
+	port := args.Int("p", "port", &argparse.Options{Required: false, Help: "Target port",
+		Default: constants.DEFAULT_PORT})
+
+	err := args.Parse(arguments)
+
+	if err != nil {
+		fmt.Print(args.Usage(err))
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	path := filepath.Clean(*file)
+	handle, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Can't open path:", err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+	tree, err := fileio.BuildMerkleTree(handle, constants.MERKLE_BLOCK_SIZE*1024)
+	handle.Close()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	comms := new(comms.Client)
+	addr := *bind + ":" + strconv.Itoa(*port)
+
+	if err = comms.Connect(addr, constants.DEFAULT_DSCP, *mptcp); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+	defer comms.Close()
+
+	nonce := comms.ServerEhlo()
+	if _, err = comms.Authenticate(*pass, nonce); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(constants.EXIT_ERROR)
+	}
+
+	name := filepath.Base(path)
+	if *dest != "" {
+		if name, err = destinationName(*dest, name); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(constants.EXIT_ERROR)
+		}
+	}
+	remote := comms.RequestTree(name)
+	switch {
+	case remote == nil:
+		fmt.Println("Server does not have", filepath.Base(path))
+		os.Exit(constants.EXIT_MISMATCH)
+	case remote.Size != tree.Size():
+		fmt.Println("File size differs. Local:", tree.Size(), "Server:", remote.Size)
+		os.Exit(constants.EXIT_MISMATCH)
+	case remote.Root == tree.Root():
+		fmt.Println("File is identical")
+		return
+	}
+
+	differing := tree.Diff(comms.QueryTree)
+	for _, leaf := range differing {
+		offset, length := tree.Block(leaf)
+		fmt.Println("Contents differ at offset", offset, "length", length)
+	}
+	fmt.Println(len(differing), "blocks differ")
+	os.Exit(constants.EXIT_MISMATCH)
+}
@@ -1,35 +1,94 @@
 package worker
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"go_fast_copy/constants"
 	"go_fast_copy/fileio"
 	"go_fast_copy/networking"
 	"go_fast_copy/networking/opcode"
+	"sync"
 	"sync/atomic"
 )
 
 type CompressingReader struct {
 	reader           fileio.FileReader
+	chunkSize        int
+	signatures       *fileio.Signatures
+	present          map[[32]byte]bool
+	checksum         chan []byte
+	verify           bool
+	sealer           *fileio.EndToEndSealer
+	sealedHash       uint8 // Checksum algorithm of encrypted contents
 	compressedChunks atomic.Uint32
 	chunksTotal      atomic.Uint32
 	dataTotal        atomic.Uint64
 	compressedData   atomic.Uint64
+	copiedData       atomic.Uint64
 }
 
 type uncompressedChunk struct {
-	seq  uint32
-	data []byte
+	seq         uint32
+	data        []byte
+	last        bool        // Last chunk of file
+	kind        uint8       // Chunk kind for chunks not carrying data
+	length      uint32      // Length of data instruction refers to
+	instruction interface{} // Copy or reference instruction
 }
 
 // StartFileReader opens new file handle for reading
 func (w *CompressingReader) StartFileReader(factory fileio.IOFactory,
-	filename string, numworkers, chunksize int) error {
+	filename string, numworkers, chunksize int, algorithm uint8) error {
 	w.compressedChunks.Store(0)
 	w.chunksTotal.Store(0)
 	w.dataTotal.Store(0)
 	w.compressedData.Store(0)
+	w.copiedData.Store(0)
+	w.chunkSize = chunksize * 1024
+	w.signatures = nil
+	w.present = nil
+	w.verify = false
+	w.sealer = nil
+	w.checksum = make(chan []byte, 1)
 	w.reader = factory.NewReader()
-	return w.reader.New(filename, chunksize*1024, numworkers)
+	return w.reader.New(filename, w.chunkSize, numworkers, algorithm)
+}
+
+// Checksum waits for all data to be read and returns checksum of it
+func (w *CompressingReader) Checksum() []byte {
+	return <-w.checksum
+}
+
+// UseDelta makes workers only send data which differs from file with given signatures
+func (w *CompressingReader) UseDelta(sigs *fileio.Signatures) {
+	w.signatures = sigs
+}
+
+// UseDedup makes workers cut file at content-defined boundaries and refer to chunks server already has
+func (w *CompressingReader) UseDedup(present map[[32]byte]bool) {
+	w.present = present
+}
+
+// UseTree makes reader build hash tree of file so server can find corrupted blocks
+func (w *CompressingReader) UseTree() {
+	w.reader.UseTree(constants.MERKLE_BLOCK_SIZE * 1024)
+}
+
+// Tree returns hash tree of file once all of it has been read
+func (w *CompressingReader) Tree() *fileio.MerkleTree {
+	return w.reader.Tree()
+}
+
+// UseChunkChecksums makes workers attach checksum to every chunk so server can detect corrupted ones
+func (w *CompressingReader) UseChunkChecksums() {
+	w.verify = true
+}
+
+// UseEndToEnd makes workers encrypt compressed chunks so server only ever sees ciphertext. Checksum of encrypted
+// contents is calculated with given algorithm instead as server can only verify those.
+func (w *CompressingReader) UseEndToEnd(sealer *fileio.EndToEndSealer, algorithm uint8) {
+	w.sealer = sealer
+	w.sealedHash = algorithm
 }
 
 // GetChunkStats returns compressed:total chunk count so far and data:compressedData
@@ -40,13 +99,22 @@ func (w *CompressingReader) GetChunkStats() (int, int, string) {
 	data := w.dataTotal.Load()
 	compData := w.compressedData.Load()
 
-	compStats := "Original size: " + humanReadableSize(data) + " Compressed size: " + humanReadableSize(compData)
+	compStats := "Original size: " + HumanReadableSize(data) + " Compressed size: " + HumanReadableSize(compData)
+
+	if copied := w.copiedData.Load(); copied > 0 {
+		compStats += " Reused from server: " + HumanReadableSize(copied)
+	}
 
 	return int(comp), int(total), compStats
 }
 
-// humanReadableSize converts file size into a human-readable form.
-func humanReadableSize(size uint64) string {
+// Progress returns original and compressed size of data processed so far
+func (w *CompressingReader) Progress() (uint64, uint64) {
+	return w.dataTotal.Load(), w.compressedData.Load()
+}
+
+// HumanReadableSize converts file size into a human-readable form.
+func HumanReadableSize(size uint64) string {
 	const (
 		_  = iota
 		KB = 1 << (10 * iota) // 1024
@@ -67,71 +135,216 @@ func humanReadableSize(size uint64) string {
 }
 
 // StartWorkers starts workers for compressing raw chunks from file
-func (w *CompressingReader) StartWorkers(numworkers int, crypto *networking.Crypto) []chan []byte {
+func (w *CompressingReader) StartWorkers(numworkers int, crypto *networking.Crypto,
+	compression *fileio.CompressionOptions) []chan *networking.ChunkMessage {
 	chunkStream := make(chan *uncompressedChunk, numworkers)
 
-	channels := make([]chan []byte, numworkers)
+	channels := make([]chan *networking.ChunkMessage, numworkers)
+
+	var sealed chan *networking.ChunkMessage
+	var working sync.WaitGroup
+	if w.sealer != nil {
+		sealed = make(chan *networking.ChunkMessage, numworkers)
+		go w.hashSealed(sealed)
+	}
 
 	// Start workers.
 	for i := 0; i < numworkers; i++ {
-		out := make(chan []byte, 3)
+		out := make(chan *networking.ChunkMessage, 3)
 		channels[i] = out
+		working.Add(1)
 
-		go func(in chan *uncompressedChunk, out chan []byte) {
+		go func(in chan *uncompressedChunk, out chan *networking.ChunkMessage) {
+			defer working.Done()
 			for chunk := range in {
-				var isCompressed uint16
+				if chunk.kind != constants.CHUNK_DATA {
+					// Server already has the data. Only tell where to find it.
+					w.dataTotal.Add(uint64(chunk.length))
+					w.copiedData.Add(uint64(chunk.length))
+					out <- &networking.ChunkMessage{Seq: chunk.seq, Data: instructionMessage(chunk, crypto, w.verify),
+						Size: chunk.length}
+					continue
+				}
 
 				w.dataTotal.Add(uint64(len(chunk.data)))
 				// Compress chunk if possible.
-				processed, compressed := fileio.CompressChunk(chunk.data)
+				processed, codec := fileio.CompressChunk(chunk.data, compression)
 				w.compressedData.Add(uint64(len(processed)))
-				processed = crypto.Encrypt(processed)
 
-				if compressed {
+				if codec != constants.CODEC_NONE {
 					w.compressedChunks.Add(1)
-					isCompressed = 1
 				}
+				if w.sealer != nil {
+					// Server stores encrypted chunk as-is without decompressing it.
+					processed = w.sealer.Seal(chunk.seq, chunk.last, codec, processed)
+					codec = constants.CODEC_NONE
+					sealed <- &networking.ChunkMessage{Seq: chunk.seq, Data: processed}
+				}
+				processed = crypto.Encrypt(processed)
 				// Prepare full message of chunk header + data for streaming over TCP.
 				nextChunk := networking.Packet{
 					Header: networking.Header{
 						Opcode: opcode.NEXTCHUNK,
-						Flags:  0,
+						Flags:  constants.CHUNK_DATA,
 					},
 				}
-				nextChunk.Payload = networking.PayloadToBytes(
-					&networking.DataStreamChunk{
-						Sequence:    chunk.seq,
-						Compression: isCompressed,
-						DataLength:  (uint32)(len(processed)),
+				stream := networking.DataStreamChunk{
+					Sequence:    chunk.seq,
+					Compression: codec,
+					DataLength:  (uint32)(len(processed)),
+				}
+				if w.verify {
+					nextChunk.Flags |= constants.CHUNK_VERIFIED
+					nextChunk.Payload = networking.PayloadToBytes(&networking.VerifiedStreamChunk{
+						DataStreamChunk: stream,
+						Checksum:        networking.ChunkChecksum(processed),
 					}, crypto)
+				} else {
+					nextChunk.Payload = networking.PayloadToBytes(&stream, crypto)
+				}
 				msg, _ := networking.PacketToBytes(&nextChunk)
 				// Pass message header followed with full chunk to be sent.
-				out <- append(msg, processed...)
+				out <- &networking.ChunkMessage{Seq: chunk.seq, Data: append(msg, processed...),
+					Size: uint32(len(chunk.data))}
 			}
 			close(out)
 		}(chunkStream, out)
 	}
 
+	if sealed != nil {
+		go func() {
+			working.Wait()
+			close(sealed)
+		}()
+	}
+
 	// Goroutine for passing raw data from file to workers.
 	go func() {
 		var chunkSeq uint32 = 1
 
-		fileChunks := w.reader.StartReading()
-
-		// Get raw chunks from file reader.
-		for raw := range fileChunks {
-			// Send to workers for processing.
-			chunkStream <- &uncompressedChunk{
-				seq:  chunkSeq,
-				data: raw,
-			}
+		// Send to workers for processing.
+		send := func(next *uncompressedChunk) {
+			next.seq = chunkSeq
+			chunkStream <- next
 			// Increment sequence number.
 			chunkSeq = chunkSeq + 1
 			w.chunksTotal.Add(1)
 		}
 
+		fileChunks, checksum := w.reader.StartReading()
+
+		switch {
+		case w.signatures != nil:
+			// Turn raw chunks into literals and copies of existing data.
+			for op := range fileio.StartDelta(fileChunks, w.signatures, w.chunkSize) {
+				if op.Data != nil {
+					send(&uncompressedChunk{data: op.Data})
+					continue
+				}
+				send(&uncompressedChunk{
+					kind:   constants.CHUNK_COPY,
+					length: op.Length,
+					instruction: &networking.BlockCopy{
+						Offset: op.Offset,
+						Length: op.Length,
+					},
+				})
+			}
+		case w.present != nil:
+			// Cut raw chunks at content-defined boundaries and refer to ones server already has.
+			for raw := range fileio.StartCDC(fileChunks) {
+				hash := sha256.Sum256(raw)
+				if !w.present[hash] {
+					send(&uncompressedChunk{data: raw})
+					continue
+				}
+				send(&uncompressedChunk{
+					kind:   constants.CHUNK_REFERENCE,
+					length: uint32(len(raw)),
+					instruction: &networking.ChunkReference{
+						Hash:   hash,
+						Length: uint32(len(raw)),
+					},
+				})
+			}
+		case w.sealer != nil:
+			// Last chunk is marked so hold each one back until next one is read.
+			var held *uncompressedChunk
+			for raw := range fileChunks {
+				if held != nil {
+					send(held)
+				}
+				held = &uncompressedChunk{data: raw}
+			}
+			if held == nil {
+				// Empty file still needs header and last chunk.
+				held = &uncompressedChunk{data: []byte{}}
+			}
+			held.last = true
+			send(held)
+		default:
+			// Get raw chunks from file reader.
+			for raw := range fileChunks {
+				send(&uncompressedChunk{data: raw})
+			}
+		}
+
 		close(chunkStream)
+		// Checksum is calculated while reading.
+		sum := <-checksum
+		if w.sealer == nil {
+			w.checksum <- sum
+		}
 	}()
 
 	return channels
 }
+
+// hashSealed calculates checksum of encrypted chunks in order of their sequence numbers
+func (w *CompressingReader) hashSealed(sealed chan *networking.ChunkMessage) {
+	hash := fileio.NewHash(w.sealedHash)
+	pending := make(map[uint32][]byte)
+	var next uint32 = 1
+	for msg := range sealed {
+		pending[msg.Seq] = msg.Data
+		for data, found := pending[next]; found; data, found = pending[next] {
+			if hash != nil {
+				hash.Write(data)
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+	var sum []byte
+	if hash != nil {
+		sum = hash.Sum(nil)
+	}
+	w.checksum <- sum
+}
+
+// instructionMessage prepares full message of chunk header + copy or reference instruction
+func instructionMessage(chunk *uncompressedChunk, crypto *networking.Crypto, verify bool) []byte {
+	instruction := networking.PayloadToBytes(chunk.instruction, crypto)
+	nextChunk := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.NEXTCHUNK,
+			Flags:  chunk.kind,
+		},
+	}
+	stream := networking.DataStreamChunk{
+		Sequence:    chunk.seq,
+		Compression: constants.CODEC_NONE,
+		DataLength:  uint32(len(instruction)),
+	}
+	if verify {
+		nextChunk.Flags |= constants.CHUNK_VERIFIED
+		nextChunk.Payload = networking.PayloadToBytes(&networking.VerifiedStreamChunk{
+			DataStreamChunk: stream,
+			Checksum:        networking.ChunkChecksum(instruction),
+		}, crypto)
+	} else {
+		nextChunk.Payload = networking.PayloadToBytes(&stream, crypto)
+	}
+	msg, _ := networking.PacketToBytes(&nextChunk)
+	return append(msg, instruction...)
+}
@@ -0,0 +1,15 @@
+package constants
+
+const (
+	CODEC_NONE     = 0 // Chunk data is sent as-is
+	CODEC_LZ4      = 1 // LZ4 block
+	CODEC_LZ4_DICT = 2 // LZ4 block referencing session dictionary
+)
+
+const (
+	CHUNK_DATA      = 0 // Chunk carries file data
+	CHUNK_COPY      = 1 // Chunk refers to range of file already existing on server
+	CHUNK_REFERENCE = 2 // Chunk refers to chunk already in server chunk store
+
+	CHUNK_VERIFIED = 0x80 // Chunk carries checksum of its payload
+)
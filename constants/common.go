@@ -1,6 +1,21 @@
 package constants
 
 const (
-	Title   = "Go Fast Copy - Fast file transfer over TCP using LZ4 compression"
-	PAXAttr = "FASTCOPY.chksm"
+	Title     = "Go Fast Copy - Fast file transfer over TCP using LZ4 compression"
+	PAXAttr   = "FASTCOPY.chksm"
+	PAXDelta  = "FASTCOPY.delta"
+	PAXDedup  = "FASTCOPY.dedup"
+	PAXTree   = "FASTCOPY.tree"
+	PAXProbe  = "FASTCOPY.probe"
+	PAXStream = "FASTCOPY.stream"
+	PAXHash   = "FASTCOPY.hash"
+	PAXSealed = "FASTCOPY.e2e"
+	PAXSkip   = "FASTCOPY.skip"
+	StoreDir  = ".gfcstore"
+	CacheFile = ".gfccache"
+
+	ArchiveIndex = ".gfcindex"
+	ArchivePart  = ".gfcarchive.part"
+	AuditLog     = ".gfcaudit"
+	FormatIndex  = ".gfcformat"
 )
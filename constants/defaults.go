@@ -9,4 +9,22 @@ const (
 	FILE_WRITE_QUEUE        = 10   // Queued chunks before blocking on file writes
 	DEFAULT_DSCP            = 0x0A // QoS for high throughput
 	MAX_OOC                 = 256  // Maximum number of buffered out-of-order chunks
+	MAX_COMPRESSION_LEVEL   = 9    // LZ4 HC maximum compression level
+	MAX_DICTIONARY_SIZE     = 64   // LZ4 dictionary maximum size in KB
+	DICTIONARY_SAMPLE_SIZE  = 16   // Sample size in KB per file for dictionary training
+	DICTIONARY_MAX_SAMPLES  = 1024 // Maximum number of files sampled for dictionary training
+	MIN_DELTA_BLOCK_SIZE    = 4    // Delta transfer minimum block size in KB
+	MAX_DELTA_BLOCK_SIZE    = 64   // Delta transfer maximum block size in KB
+	SIGNATURES_PER_MESSAGE  = 3000 // Block signatures sent per message
+	MIN_CDC_CHUNK_SIZE      = 16   // Content-defined chunk minimum size in KB
+	AVG_CDC_CHUNK_SIZE      = 64   // Content-defined chunk average size in KB
+	MAX_CDC_CHUNK_SIZE      = 256  // Content-defined chunk maximum size in KB
+	RETRANSMIT_WINDOW       = 256  // Number of most recently sent chunks client can send again, at least MAX_OOC
+	MAX_RETRANSMITS         = 3    // Maximum number of times a single chunk is sent again
+	HASHES_PER_QUERY        = 2000 // Chunk hashes queried per message
+	MERKLE_BLOCK_SIZE       = 1024 // Hash tree block size in KB
+	DEFAULT_ARCHIVE_SIZE    = 1024 // Size in MB at which archive is rotated
+	SEAL_SEGMENT_SIZE       = 64   // Size in KB of separately encrypted segments of files encrypted at rest
+	DEFAULT_LOG_SIZE        = 100  // Size in MB at which server log file is rotated
+	DEFAULT_LOG_FILES       = 5    // Number of rotated server log files kept
 )
@@ -0,0 +1,8 @@
+package constants
+
+const (
+	EXIT_OK       = 0 // Everything was sent, skipped as identical or verified
+	EXIT_ERROR    = 1 // Invalid arguments, unreadable files, failed connection or request refused by server
+	EXIT_MISMATCH = 2 // Checksum or verification mismatch
+	EXIT_LOST     = 3 // Connection to server was lost
+)
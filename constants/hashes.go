@@ -0,0 +1,10 @@
+package constants
+
+const (
+	HASH_NONE       = 0 // Checksum is not calculated
+	HASH_CRC32      = 1 // CRC32 (IEEE)
+	HASH_SHA256     = 2 // SHA256
+	HASH_XXH3       = 3 // xxHash3 128-bit
+	HASH_BLAKE3     = 4 // BLAKE3 256-bit
+	HASH_SHA512_256 = 5 // SHA-512/256
+)
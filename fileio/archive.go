@@ -0,0 +1,284 @@
+package fileio
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"go_fast_copy/constants"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveEntry is index record of file appended to archive
+type ArchiveEntry struct {
+	Name     string    `json:"name"`
+	Archive  string    `json:"archive"`
+	Offset   int64     `json:"offset"` // Offset of tar header, start of zstd frame if compressed
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+	Format   string    `json:"format,omitempty"` // Format file is stored in within archive
+}
+
+// Archive appends files to rolling tar archives under folder. Archive is always left with end-of-archive marker so
+// it can be read at any time. When compressed, every file is separate zstd frame so it can be read starting from
+// offset in index.
+type Archive struct {
+	folder   string
+	compress bool
+	maxSize  int64
+	maxAge   time.Duration
+	file     *os.File
+	name     string
+	created  time.Time
+	end      int64 // Offset of end-of-archive marker which next file overwrites
+	encoder  *zstd.Encoder
+	index    *os.File
+}
+
+// NewArchive opens index of archives under folder. Archives are rotated once they grow larger than max size or
+// older than max age. Zero disables either limit.
+func NewArchive(folder string, compress bool, maxSize int64, maxAge time.Duration) (*Archive, error) {
+	index, err := os.OpenFile(filepath.Join(folder, constants.ArchiveIndex), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{folder: folder, compress: compress, maxSize: maxSize, maxAge: maxAge, index: index}
+	if compress {
+		if a.encoder, err = zstd.NewWriter(nil); err != nil {
+			index.Close()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Append adds contents of file at given path to archive under name, modification time and PAX records of header.
+// File is recorded as stored in given format. Index record of file is returned.
+func (a *Archive) Append(header *tar.Header, path, format string) (*ArchiveEntry, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header.Size = info.Size()
+
+	if a.file != nil && a.maxAge > 0 && time.Since(a.created) >= a.maxAge {
+		a.rotate()
+	}
+	if a.file == nil {
+		if err = a.create(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Overwrite end-of-archive marker.
+	offset := a.end
+	if err = a.file.Truncate(offset); err == nil {
+		_, err = a.file.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = a.writeFrame(func(w io.Writer) error {
+			tarra := tar.NewWriter(w)
+			if err := tarra.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tarra, source); err != nil {
+				return err
+			}
+			return tarra.Flush()
+		})
+	}
+	if err == nil {
+		a.end, err = a.file.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		// Leave archive as it was before.
+		a.end = offset
+		a.finish()
+		return nil, err
+	}
+	if err = a.finish(); err != nil {
+		return nil, err
+	}
+
+	entry := &ArchiveEntry{
+		Name:     header.Name,
+		Archive:  a.name,
+		Offset:   offset,
+		Size:     header.Size,
+		ModTime:  header.ModTime,
+		Checksum: header.PAXRecords[constants.PAXAttr],
+		Hash:     header.PAXRecords[constants.PAXHash],
+		Format:   format,
+	}
+	line, _ := json.Marshal(entry)
+	if _, err = a.index.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	if a.maxSize > 0 && a.end >= a.maxSize {
+		a.rotate()
+	}
+	return entry, nil
+}
+
+// Close closes current archive and index
+func (a *Archive) Close() {
+	a.rotate()
+	a.index.Close()
+}
+
+// create starts new archive named after current time
+func (a *Archive) create() error {
+	extension := ".tar"
+	if a.compress {
+		extension += ".zst"
+	}
+	a.created = time.Now()
+	base := "archive-" + a.created.UTC().Format("20060102-150405")
+	for i := 0; ; i++ {
+		a.name = base + extension
+		if i > 0 {
+			a.name = base + "-" + strconv.Itoa(i) + extension
+		}
+		file, err := os.OpenFile(filepath.Join(a.folder, a.name), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+		if err == nil {
+			a.file = file
+			a.end = 0
+			return nil
+		} else if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+}
+
+// rotate closes current archive so next file starts new one
+func (a *Archive) rotate() {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// finish writes end-of-archive marker after last file and flushes archive to disk
+func (a *Archive) finish() error {
+	a.file.Truncate(a.end)
+	a.file.Seek(a.end, io.SeekStart)
+	err := a.writeFrame(func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 1024))
+		return err
+	})
+	if err == nil {
+		err = a.file.Sync()
+	}
+	return err
+}
+
+// writeFrame writes data to archive, compressed as single zstd frame if compression is in use
+func (a *Archive) writeFrame(write func(w io.Writer) error) error {
+	if a.encoder == nil {
+		return write(a.file)
+	}
+	a.encoder.Reset(a.file)
+	if err := write(a.encoder); err != nil {
+		a.encoder.Close()
+		return err
+	}
+	return a.encoder.Close()
+}
+
+// FindArchived looks up most recently archived file with given name in index of archives under folder
+func FindArchived(folder, name string) (*ArchiveEntry, error) {
+	index, err := os.Open(filepath.Join(folder, constants.ArchiveIndex))
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	var found *ArchiveEntry
+	scanner := bufio.NewScanner(index)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := new(ArchiveEntry)
+		if json.Unmarshal(scanner.Bytes(), entry) == nil && entry.Name == name {
+			found = entry
+		}
+	}
+	if found == nil {
+		return nil, os.ErrNotExist
+	}
+	return found, scanner.Err()
+}
+
+// archivedReader reads contents of file from archive
+type archivedReader struct {
+	io.Reader
+	file    *os.File
+	decoder *zstd.Decoder
+}
+
+func (r *archivedReader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return r.file.Close()
+}
+
+// OpenArchived returns reader of contents of archived file described by index record. Key is needed to decrypt
+// files encrypted at rest.
+func OpenArchived(folder string, entry *ArchiveEntry, key []byte) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(folder, filepath.Base(entry.Archive)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(entry.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := &archivedReader{file: file}
+	var stream io.Reader = file
+	if strings.HasSuffix(entry.Archive, ".zst") {
+		if reader.decoder, err = zstd.NewReader(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		stream = reader.decoder
+	}
+
+	tarra := tar.NewReader(stream)
+	if _, err = tarra.Next(); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	reader.Reader = tarra
+
+	member := bufio.NewReader(tarra)
+	if entry.Format == FormatSealed {
+		if key == nil {
+			reader.Close()
+			return nil, errors.New(entry.Name + " is encrypted but key is not available")
+		}
+		if reader.Reader, err = NewSealReader(member, key); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	} else {
+		reader.Reader = member
+	}
+	return reader, nil
+}
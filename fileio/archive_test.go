@@ -0,0 +1,149 @@
+package fileio
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// readArchive returns names of all files in archive read from start with standard tar reader
+func readArchive(t *testing.T, filename string) []string {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var stream io.Reader = file
+	if strings.HasSuffix(filename, ".zst") {
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		stream = decoder
+	}
+
+	var names []string
+	tarra := tar.NewReader(stream)
+	for {
+		header, err := tarra.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatalf("reading %s: %v", filepath.Base(filename), err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{".tar", false},
+		{".tar.zst", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder := t.TempDir()
+			source := t.TempDir()
+			archive, err := NewArchive(folder, test.compress, 6000, 0)
+			if err != nil {
+				t.Fatalf("NewArchive: %v", err)
+			}
+
+			// Same names are archived again with other contents, latest is expected back.
+			contents := make(map[string][]byte)
+			archives := make(map[string][]string)
+			for i := 0; i < 12; i++ {
+				name := fmt.Sprintf("file%d", i%4)
+				// Random contents keep compressed archive growing too.
+				data := make([]byte, 1000+i)
+				rand.Read(data)
+				path := filepath.Join(source, name)
+				os.WriteFile(path, data, 0644)
+
+				header := &tar.Header{Name: name, Mode: 0644, ModTime: time.Now()}
+				entry, err := archive.Append(header, path, FormatPlain)
+				if err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+				if !strings.HasSuffix(entry.Archive, test.name) {
+					t.Errorf("archive %s is not %s", entry.Archive, test.name)
+				}
+				contents[name] = data
+				archives[entry.Archive] = append(archives[entry.Archive], name)
+
+				// Archive being written to is complete after every file.
+				if names := readArchive(t, filepath.Join(folder, entry.Archive)); len(names) != len(archives[entry.Archive]) {
+					t.Errorf("%s holds %v after appending %v", entry.Archive, names, archives[entry.Archive])
+				}
+			}
+			archive.Close()
+
+			if len(archives) < 2 {
+				t.Errorf("archive was not rotated by size")
+			}
+			for name, names := range archives {
+				info, _ := os.Stat(filepath.Join(folder, name))
+				if len(names) > 1 && info.Size() > 6000+2048 {
+					t.Errorf("%s grew to %d bytes", name, info.Size())
+				}
+			}
+
+			for name, data := range contents {
+				entry, err := FindArchived(folder, name)
+				if err != nil {
+					t.Fatalf("FindArchived(%s): %v", name, err)
+				}
+				reader, err := OpenArchived(folder, entry, nil)
+				if err != nil {
+					t.Fatalf("OpenArchived(%s): %v", name, err)
+				}
+				read, err := io.ReadAll(reader)
+				reader.Close()
+				if err != nil || !bytes.Equal(read, data) {
+					t.Errorf("read %d bytes of %s at offset %d, error %v, want %d bytes", len(read), name,
+						entry.Offset, err, len(data))
+				}
+			}
+
+			if _, err := FindArchived(folder, "missing"); err == nil {
+				t.Errorf("FindArchived found file never archived")
+			}
+		})
+	}
+}
+
+func TestArchiveRotatesByAge(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, []byte("contents"), 0644)
+
+	archive, err := NewArchive(folder, false, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	first, _ := archive.Append(&tar.Header{Name: "a"}, path, FormatPlain)
+	second, _ := archive.Append(&tar.Header{Name: "b"}, path, FormatPlain)
+	if first.Archive != second.Archive {
+		t.Errorf("archive was rotated before it got old")
+	}
+	archive.created = archive.created.Add(-2 * time.Hour)
+	third, _ := archive.Append(&tar.Header{Name: "c"}, path, FormatPlain)
+	if third.Archive == second.Archive {
+		t.Errorf("old archive was not rotated")
+	}
+}
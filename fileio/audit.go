@@ -0,0 +1,90 @@
+package fileio
+
+import (
+	"bufio"
+	"encoding/json"
+	"go_fast_copy/constants"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Results of file transfer recorded in audit log
+const (
+	AuditCompleted = "completed" // File was received and verified
+	AuditIdentical = "identical" // Identical file was already stored so nothing was sent
+	AuditRejected  = "rejected"  // Server refused to receive the file
+	AuditMismatch  = "mismatch"  // Checksum of received file did not match
+	AuditFailed    = "failed"    // File was received but could not be stored
+	AuditAborted   = "aborted"   // Client disconnected before transfer ended
+)
+
+// AuditRecord is record of single file transfer attempt
+type AuditRecord struct {
+	Time     time.Time `json:"time"` // When transfer was requested
+	Session  string    `json:"session"`
+	Remote   string    `json:"remote"`   // Address of client
+	Identity string    `json:"identity"` // Fingerprint of key client authenticated with, anonymous if none
+	Name     string    `json:"name"`     // Path requested by client
+	Path     string    `json:"path,omitempty"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Result   string    `json:"result"`
+	Skipped  bool      `json:"skipped"`
+	Duration int64     `json:"duration_ms"`
+}
+
+// AuditLog appends records of file transfers to audit log under root folder. Records are never changed or removed.
+type AuditLog struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// OpenAuditLog opens audit log under folder for appending
+func OpenAuditLog(folder string) (*AuditLog, error) {
+	file, err := os.OpenFile(filepath.Join(folder, constants.AuditLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record appends record to audit log and flushes it to disk. Does nothing if log is nil.
+func (a *AuditLog) Record(record *AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	line, _ := json.Marshal(record)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close closes audit log
+func (a *AuditLog) Close() {
+	a.file.Close()
+}
+
+// ReadAuditLog calls given function with every record of audit log under folder, oldest first
+func ReadAuditLog(folder string, found func(record *AuditRecord)) error {
+	log, err := os.Open(filepath.Join(folder, constants.AuditLog))
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := new(AuditRecord)
+		if json.Unmarshal(scanner.Bytes(), record) == nil {
+			found(record)
+		}
+	}
+	return scanner.Err()
+}
@@ -2,6 +2,7 @@ package fileio
 
 import (
 	"bufio"
+	"hash"
 	"os"
 )
 
@@ -11,12 +12,15 @@ type BufferedReader struct {
 	reader    *bufio.Reader
 	chunkSize int
 	rqLen     int
+	hash      hash.Hash
+	tree      *MerkleTree
 }
 
 // New opens file for reading or returns error upon failing to do so
-func (b *BufferedReader) New(filename string, chunkSize, numchunks int) error {
+func (b *BufferedReader) New(filename string, chunkSize, numchunks int, algorithm uint8) error {
 	file, err := os.Open(filename)
 	if err == nil {
+		b.hash = NewHash(algorithm)
 		b.file = file
 		b.chunkSize = chunkSize
 		b.rqLen = numchunks
@@ -26,18 +30,36 @@ func (b *BufferedReader) New(filename string, chunkSize, numchunks int) error {
 	return err
 }
 
-// StartReading starts a goroutine to read file contents in chunks
-func (b *BufferedReader) StartReading() chan []byte {
+// UseTree makes reader build hash tree over blocks of given size while reading
+func (b *BufferedReader) UseTree(blockSize int) {
+	b.tree = NewMerkleTree(blockSize)
+}
+
+// Tree returns hash tree of file contents once all of it has been read
+func (b *BufferedReader) Tree() *MerkleTree {
+	return b.tree
+}
+
+// StartReading starts a goroutine to read file contents in chunks. Checksum of contents follows once read.
+func (b *BufferedReader) StartReading() (chan []byte, chan []byte) {
 	if b.file == nil {
 		panic("cannot start reading without file handle")
 	}
+	hash := make(chan []byte, 1)
 	outChan := make(chan []byte, b.rqLen)
-	go func(channel chan []byte) {
+	go func(channel chan []byte, result chan []byte) {
 		for {
 			buf := make([]byte, b.chunkSize)
 			// Read from file.
 			read, _ := b.reader.Read(buf)
 			if read > 0 {
+				// Update hash.
+				if b.hash != nil {
+					b.hash.Write(buf[:read])
+				}
+				if b.tree != nil {
+					b.tree.Write(buf[:read])
+				}
 				channel <- buf[:read]
 			} else {
 				// File has been fully consumed.
@@ -46,6 +68,18 @@ func (b *BufferedReader) StartReading() chan []byte {
 		}
 		close(outChan)
 		b.file.Close()
-	}(outChan)
-	return outChan
+
+		if b.tree != nil {
+			b.tree.Finish()
+		}
+
+		// Get checksum for all data read.
+		if b.hash != nil {
+			result <- b.hash.Sum(nil)
+		} else {
+			result <- nil
+		}
+		close(result)
+	}(outChan, hash)
+	return outChan, hash
 }
@@ -2,37 +2,81 @@ package fileio
 
 import (
 	"bufio"
-	"crypto/sha256"
 	"encoding/binary"
 	"hash"
+	"io"
 	"os"
 )
 
 // BufferedWriter does buffered write to file
 type BufferedWriter struct {
-	file       *os.File
-	writer     *bufio.Writer
-	wqLen      int
-	crc32Hash  uint32
-	sha256Hash hash.Hash
+	file     *os.File
+	writer   *bufio.Writer
+	wqLen    int
+	hash     hash.Hash
+	tree     *MerkleTree
+	key      []byte         // Encryption key of files encrypted at rest
+	seal     io.WriteCloser // Encrypts contents before they are written to file
+	packed   bool           // Chunks are frames of packed file
+	manifest bool           // Chunks are entries of manifest
+	size     int64          // Size of original contents written so far
 }
 
 // New creates new file for writing or returns error upon failing to do so
-func (b *BufferedWriter) New(filename string, bufferSize, qlen int, sha bool) error {
+func (b *BufferedWriter) New(filename string, bufferSize, qlen int, algorithm uint8) error {
 	file, err := os.Create(filename)
 	if err == nil {
-		if sha {
-			b.sha256Hash = sha256.New()
-		}
+		b.hash = NewHash(algorithm)
 		b.file = file
+		var out io.Writer = file
+		if b.key != nil {
+			if b.seal, err = NewSealWriter(file, b.key); err != nil {
+				file.Close()
+				return err
+			}
+			out = b.seal
+		}
 		// New buffered writer.
-		b.writer = bufio.NewWriterSize(b.file, bufferSize)
+		b.writer = bufio.NewWriterSize(out, bufferSize)
+		if b.packed {
+			b.writer.WriteString(PackMagic)
+		}
 		b.wqLen = qlen
 		return nil
 	}
 	return err
 }
 
+// UseTree makes writer build hash tree over blocks of given size while writing
+func (b *BufferedWriter) UseTree(blockSize int) {
+	b.tree = NewMerkleTree(blockSize)
+}
+
+// Tree returns hash tree of file contents once all of it has been written
+func (b *BufferedWriter) Tree() *MerkleTree {
+	return b.tree
+}
+
+// Size returns size of original contents of file once all of it has been written
+func (b *BufferedWriter) Size() int64 {
+	return b.size
+}
+
+// contentLength returns length of original contents chunk stands for
+func (b *BufferedWriter) contentLength(chunk []byte) int64 {
+	switch {
+	case b.packed:
+		return int64(PackedLength(chunk))
+	case b.manifest:
+		var length int64
+		for ; len(chunk) >= manifestEntrySize; chunk = chunk[manifestEntrySize:] {
+			length += int64(binary.LittleEndian.Uint32(chunk[manifestEntrySize-4:]))
+		}
+		return length
+	}
+	return int64(len(chunk))
+}
+
 // StartWriting starts goroutine for writing chunks of data to file
 func (b *BufferedWriter) StartWriting() (chan []byte, chan []byte) {
 	if b.file == nil {
@@ -44,28 +88,43 @@ func (b *BufferedWriter) StartWriting() (chan []byte, chan []byte) {
 	// Start consuming queue in goroutine.
 	go func(chunkStream chan []byte, result chan []byte) {
 		for chunk := range chunkStream {
-			// Write to file.
-			b.writer.Write(chunk)
+			if b.packed {
+				// Checksum is calculated over original contents workers appended to frame.
+				var frame []byte
+				frame, chunk = SplitFrame(chunk)
+				b.writer.Write(frame)
+				b.size += b.contentLength(frame)
+			} else {
+				// Write to file.
+				b.writer.Write(chunk)
+				b.size += b.contentLength(chunk)
+			}
 
 			// Update hash.
-			if b.sha256Hash != nil {
-				progressiveChecksumSHA256(b.sha256Hash, chunk)
-			} else {
-				b.crc32Hash = progressiveChecksumCRC32(b.crc32Hash, chunk)
+			if b.hash != nil {
+				b.hash.Write(chunk)
+			}
+			if b.tree != nil {
+				b.tree.Write(chunk)
 			}
 		}
 
 		// Write any remaining bytes.
 		b.writer.Flush()
+		if b.seal != nil {
+			b.seal.Close()
+		}
 		b.file.Close()
 
 		var bytes []byte
 
-		// Get SHA256 or CRC32 checksum for all data written so far.
-		if b.sha256Hash != nil {
-			bytes = b.sha256Hash.Sum(nil)
-		} else {
-			bytes = binary.BigEndian.AppendUint32(make([]byte, 0, 4), b.crc32Hash)
+		if b.tree != nil {
+			b.tree.Finish()
+		}
+
+		// Get checksum for all data written so far.
+		if b.hash != nil {
+			bytes = b.hash.Sum(nil)
 		}
 
 		// Signal that all data has been written.
@@ -0,0 +1,105 @@
+package fileio
+
+import (
+	"crypto/sha256"
+	"go_fast_copy/constants"
+)
+
+// gear holds random values used by gear hash. Values must never change as they determine chunk boundaries.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	// SplitMix64 with fixed seed.
+	seed := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// GetFileManifest cuts file into content-defined chunks and returns manifest entries describing them
+func GetFileManifest(filename string, chunkSize int) ([]ManifestEntry, error) {
+	reader := new(BufferedReader)
+	if err := reader.New(filename, chunkSize, 2, constants.HASH_NONE); err != nil {
+		return nil, err
+	}
+	chunks, _ := reader.StartReading()
+	entries := make([]ManifestEntry, 0)
+	for chunk := range StartCDC(chunks) {
+		entries = append(entries, ManifestEntry{Hash: sha256.Sum256(chunk), Length: uint32(len(chunk))})
+	}
+	return entries, nil
+}
+
+// StartCDC starts goroutine cutting stream of raw chunks into content-defined chunks using FastCDC
+func StartCDC(chunks chan []byte) chan []byte {
+	out := make(chan []byte, 2)
+
+	go func() {
+		minSize := constants.MIN_CDC_CHUNK_SIZE * 1024
+		avgSize := constants.AVG_CDC_CHUNK_SIZE * 1024
+		maxSize := constants.MAX_CDC_CHUNK_SIZE * 1024
+
+		bits := 0
+		for 1<<bits < avgSize {
+			bits++
+		}
+		// Normalized chunking makes cut points harder to hit before average size and easier after it.
+		maskS := ^uint64(0) << (64 - (bits + 2))
+		maskL := ^uint64(0) << (64 - (bits - 2))
+
+		var pending []byte
+		eof := false
+
+		for {
+			// Buffer enough data for a chunk of maximum size.
+			for !eof && len(pending) < maxSize {
+				chunk, open := <-chunks
+				if !open {
+					eof = true
+					break
+				}
+				pending = append(pending, chunk...)
+			}
+			if len(pending) == 0 {
+				break
+			}
+
+			cut := cutPoint(pending, minSize, avgSize, maxSize, maskS, maskL)
+			out <- pending[:cut:cut]
+			pending = pending[cut:]
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// cutPoint returns length of next content-defined chunk in data
+func cutPoint(data []byte, minSize, avgSize, maxSize int, maskS, maskL uint64) int {
+	if len(data) <= minSize {
+		return len(data)
+	}
+	size := min(len(data), maxSize)
+	normal := min(size, avgSize)
+
+	var fp uint64
+	i := minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskS == 0 {
+			return i
+		}
+	}
+	for ; i < size; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskL == 0 {
+			return i
+		}
+	}
+	return size
+}
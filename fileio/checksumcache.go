@@ -0,0 +1,160 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"go_fast_copy/constants"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checksumRecord is verified checksum of file along with size and modification time it's valid for
+type checksumRecord struct {
+	Path      string `json:"path,omitempty"`
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"`
+}
+
+// ChecksumCache remembers checksums of files so unchanged ones need not be hashed again. Checksums are kept
+// in extended attribute of each file, or in sidecar database where extended attributes are unavailable.
+type ChecksumCache struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]*checksumRecord
+	lines   int // Records in sidecar database, including ones overridden since
+}
+
+// xattrName is name of extended attribute holding checksum record
+const xattrName = "user." + constants.PAXAttr
+
+// sidecarSlack is number of overridden records sidecar database may hold before it is rewritten
+const sidecarSlack = 1024
+
+// NewChecksumCache returns cache using sidecar database at given path as fallback
+func NewChecksumCache(path string) *ChecksumCache {
+	return &ChecksumCache{path: path}
+}
+
+// Get returns cached checksum of file if it was calculated with given algorithm and file has not changed since
+func (c *ChecksumCache) Get(filename string, info os.FileInfo, algorithm uint8) []byte {
+	var record *checksumRecord
+	if value, err := getXattr(filename, xattrName); err == nil {
+		record = new(checksumRecord)
+		if json.Unmarshal(value, record) != nil {
+			return nil
+		}
+	} else {
+		c.lock.Lock()
+		c.load()
+		record = c.entries[filename]
+		c.lock.Unlock()
+	}
+
+	if record == nil || record.Algorithm != HashName(algorithm) ||
+		record.Size != info.Size() || record.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	checksum, err := hex.DecodeString(record.Checksum)
+	if err != nil {
+		return nil
+	}
+	return checksum
+}
+
+// Put caches checksum of file calculated with given algorithm
+func (c *ChecksumCache) Put(filename string, algorithm uint8, checksum []byte) {
+	info, err := os.Stat(filename)
+	if err != nil || algorithm == constants.HASH_NONE {
+		return
+	}
+	record := &checksumRecord{
+		Algorithm: HashName(algorithm),
+		Checksum:  hex.EncodeToString(checksum),
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+	}
+
+	value, _ := json.Marshal(record)
+	if setXattr(filename, xattrName, value) == nil {
+		return
+	}
+
+	// Fall back to sidecar database.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.load()
+	record.Path = filename
+	c.entries[filename] = record
+
+	if c.lines-len(c.entries) >= sidecarSlack {
+		c.compact()
+		return
+	}
+
+	db, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	line, _ := json.Marshal(record)
+	if _, err = db.Write(append(line, '\n')); err == nil {
+		c.lines++
+	}
+}
+
+// load reads sidecar database once. Later records override earlier ones for the same file. Database is rewritten
+// without overridden records and records of files which have since changed or been removed.
+func (c *ChecksumCache) load() {
+	if c.entries != nil {
+		return
+	}
+	c.entries = make(map[string]*checksumRecord)
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		record := new(checksumRecord)
+		if json.Unmarshal(scanner.Bytes(), record) == nil && record.Path != "" {
+			c.entries[record.Path] = record
+		}
+		c.lines++
+	}
+
+	for path, record := range c.entries {
+		if info, err := os.Stat(path); err != nil || record.Size != info.Size() ||
+			record.ModTime != info.ModTime().UnixNano() {
+			delete(c.entries, path)
+		}
+	}
+	if c.lines > len(c.entries) {
+		c.compact()
+	}
+}
+
+// compact rewrites sidecar database with only current records. New database replaces old one only once written.
+func (c *ChecksumCache) compact() {
+	buffer := new(bytes.Buffer)
+	for _, record := range c.entries {
+		line, _ := json.Marshal(record)
+		buffer.Write(append(line, '\n'))
+	}
+	temp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return
+	}
+	_, err = temp.Write(buffer.Bytes())
+	temp.Close()
+	if err != nil || os.Rename(temp.Name(), c.path) != nil {
+		os.Remove(temp.Name())
+		return
+	}
+	c.lines = len(c.entries)
+}
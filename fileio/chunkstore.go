@@ -0,0 +1,192 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestMagic identifies files stored as list of chunks in chunk store
+const ManifestMagic = "GFCMANIFEST1\n"
+
+// ManifestEntry describes a single chunk of file stored as manifest
+type ManifestEntry struct {
+	Hash   [32]byte // SHA256 of chunk
+	Length uint32   // Chunk length
+}
+
+// manifestEntrySize is size of manifest entry as stored
+const manifestEntrySize = 36
+
+// ChunkStore is content-addressed storage of chunks keyed by their SHA256
+type ChunkStore struct {
+	dir string
+}
+
+// NewChunkStore opens chunk store in given directory creating it if needed
+func NewChunkStore(dir string) (*ChunkStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &ChunkStore{dir: dir}, nil
+}
+
+// path returns location of chunk with given hash
+func (c *ChunkStore) path(hash [32]byte) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// Has returns true if chunk with given hash is stored
+func (c *ChunkStore) Has(hash [32]byte) bool {
+	_, err := os.Stat(c.path(hash))
+	return err == nil
+}
+
+// Put stores chunk and returns manifest entry describing it
+func (c *ChunkStore) Put(data []byte) (ManifestEntry, error) {
+	entry := ManifestEntry{Hash: sha256.Sum256(data), Length: uint32(len(data))}
+	if c.Has(entry.Hash) {
+		return entry, nil
+	}
+
+	path := c.path(entry.Hash)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return entry, err
+	}
+
+	// Write under temporary name so partially written chunk never appears under its hash.
+	temp, err := os.CreateTemp(filepath.Dir(path), ".chunk")
+	if err != nil {
+		return entry, err
+	}
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return entry, err
+	}
+	temp.Close()
+
+	return entry, os.Rename(temp.Name(), path)
+}
+
+// Get returns contents of chunk with given hash
+func (c *ChunkStore) Get(hash [32]byte) ([]byte, error) {
+	data, err := os.ReadFile(c.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(data) != hash {
+		return nil, errors.New("chunk " + hex.EncodeToString(hash[:]) + " is corrupted")
+	}
+	return data, nil
+}
+
+// EncodeEntry returns manifest entry as bytes the way it's stored in manifest
+func EncodeEntry(entry ManifestEntry) []byte {
+	return binary.LittleEndian.AppendUint32(append(make([]byte, 0, manifestEntrySize), entry.Hash[:]...), entry.Length)
+}
+
+// ManifestWriter writes manifest entries to file following manifest header
+type ManifestWriter struct {
+	BufferedWriter
+}
+
+// New creates new manifest file for writing or returns error upon failing to do so
+func (m *ManifestWriter) New(filename string, bufferSize, qlen int, algorithm uint8) error {
+	if err := m.BufferedWriter.New(filename, bufferSize, qlen, algorithm); err != nil {
+		return err
+	}
+	m.manifest = true
+	_, err := m.writer.WriteString(ManifestMagic)
+	return err
+}
+
+// ManifestFactory returns buffered reader and writer for manifests
+type ManifestFactory struct {
+	BufferedFactory
+}
+
+func (m *ManifestFactory) NewWriter() FileWriter {
+	return new(ManifestWriter)
+}
+
+// manifestReader reads contents of file stored as manifest
+type manifestReader struct {
+	file    *os.File
+	entries *bufio.Reader
+	store   *ChunkStore
+	current []byte
+}
+
+func (m *manifestReader) Read(p []byte) (int, error) {
+	for len(m.current) == 0 {
+		var entry ManifestEntry
+		if err := binary.Read(m.entries, binary.LittleEndian, &entry); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errors.New("truncated manifest")
+			}
+			return 0, err
+		}
+		data, err := m.store.Get(entry.Hash)
+		if err != nil {
+			return 0, err
+		}
+		m.current = data
+	}
+	n := copy(p, m.current)
+	m.current = m.current[n:]
+	return n, nil
+}
+
+func (m *manifestReader) Close() error {
+	return m.file.Close()
+}
+
+// OpenStored opens file stored in given format for reading its original contents. Key is needed to decrypt files
+// encrypted at rest.
+func OpenStored(filename, format string, store *ChunkStore, key []byte) (io.ReadCloser, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader = bufio.NewReader(handle)
+	switch format {
+	case FormatSealed:
+		if key == nil {
+			err = errors.New(filename + " is encrypted but key is not available")
+		} else {
+			reader, err = NewSealReader(reader, key)
+		}
+	case FormatPacked:
+		reader, err = NewPackReader(reader)
+	case FormatManifest:
+		if store == nil {
+			handle.Close()
+			return nil, errors.New(filename + " is stored as manifest but chunk store is not available")
+		}
+		entries := bufio.NewReader(reader)
+		if magic, _ := entries.Peek(len(ManifestMagic)); !bytes.Equal(magic, []byte(ManifestMagic)) {
+			handle.Close()
+			return nil, errors.New(filename + " is not a valid manifest")
+		}
+		entries.Discard(len(ManifestMagic))
+		return &manifestReader{file: handle, entries: entries, store: store}, nil
+	}
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, handle}, nil
+}
@@ -0,0 +1,158 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"go_fast_copy/constants"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkStore(t *testing.T) {
+	store, err := NewChunkStore(filepath.Join(t.TempDir(), constants.StoreDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"small", []byte("chunk")},
+		{"stored again", []byte("chunk")},
+		{"large", bytes.Repeat([]byte{7}, 256*1024)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry, err := store.Put(test.data)
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if entry.Hash != sha256.Sum256(test.data) || entry.Length != uint32(len(test.data)) {
+				t.Errorf("Put returned entry %x/%d", entry.Hash, entry.Length)
+			}
+			if !store.Has(entry.Hash) {
+				t.Errorf("Has returned false for stored chunk")
+			}
+			data, err := store.Get(entry.Hash)
+			if err != nil || !bytes.Equal(data, test.data) {
+				t.Errorf("Get returned %d bytes, error %v", len(data), err)
+			}
+		})
+	}
+
+	if store.Has(sha256.Sum256([]byte("missing"))) {
+		t.Errorf("Has returned true for chunk never stored")
+	}
+
+	entry, _ := store.Put([]byte("to be corrupted"))
+	os.WriteFile(store.path(entry.Hash), []byte("corrupted"), 0644)
+	if _, err := store.Get(entry.Hash); err == nil {
+		t.Errorf("Get returned corrupted chunk without error")
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	random := make([]byte, 300*1024)
+	rand.Read(random)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"no chunks", nil},
+		{"single chunk", [][]byte{random[:1000]}},
+		{"repeated chunks", [][]byte{random[:64*1024], random[64*1024:], random[:64*1024]}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewChunkStore(filepath.Join(dir, constants.StoreDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(dir, "file")
+
+			writer := new(ManifestFactory).NewWriter()
+			if err := writer.New(filename, 4096, 2, constants.HASH_SHA256); err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			stream, done := writer.StartWriting()
+			var original []byte
+			for _, chunk := range test.chunks {
+				entry, err := store.Put(chunk)
+				if err != nil {
+					t.Fatalf("Put: %v", err)
+				}
+				stream <- EncodeEntry(entry)
+				original = append(original, chunk...)
+			}
+			close(stream)
+			<-done
+
+			if writer.Size() != int64(len(original)) {
+				t.Errorf("Size = %d, want %d", writer.Size(), len(original))
+			}
+
+			reader, err := OpenStored(filename, FormatManifest, store, nil)
+			if err != nil {
+				t.Fatalf("OpenStored: %v", err)
+			}
+			defer reader.Close()
+			contents, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading manifest: %v", err)
+			}
+			if !bytes.Equal(contents, original) {
+				t.Errorf("read %d bytes, want original %d bytes", len(contents), len(original))
+			}
+		})
+	}
+}
+
+func TestOpenStoredManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewChunkStore(filepath.Join(dir, constants.StoreDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := store.Put([]byte("chunk"))
+	missing := ManifestEntry{Hash: sha256.Sum256([]byte("missing")), Length: 7}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		store    *ChunkStore
+		openErr  bool // Error expected from OpenStored instead of reading
+	}{
+		{"no store", []byte(ManifestMagic), nil, true},
+		{"plain file", []byte("not a manifest at all"), store, true},
+		{"missing chunk", append([]byte(ManifestMagic), EncodeEntry(missing)...), store, false},
+		{"truncated entry", append([]byte(ManifestMagic), EncodeEntry(entry)[:20]...), store, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "manifest")
+			os.WriteFile(filename, test.contents, 0644)
+			reader, err := OpenStored(filename, FormatManifest, test.store, nil)
+			if test.openErr {
+				if err == nil {
+					reader.Close()
+					t.Errorf("OpenStored succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenStored: %v", err)
+			}
+			defer reader.Close()
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Errorf("invalid manifest was read without error")
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"go_fast_copy/constants"
+	"io"
+	"math"
+	"os"
+)
+
+// BlockSignature contains weak rolling and strong checksums of a block
+type BlockSignature struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// Signatures describes all full blocks of a file
+type Signatures struct {
+	BlockSize int
+	Blocks    []BlockSignature
+}
+
+// DeltaOp is either literal data or instruction to copy a range from file already existing on receiving end
+type DeltaOp struct {
+	Data   []byte // Literal data or nil if copy
+	Offset uint64 // Copy offset in existing file
+	Length uint32 // Copy length
+}
+
+// DeltaBlockSize returns block size to use for file of given size
+func DeltaBlockSize(size int64) int {
+	// Square root of file size keeps number of signatures and cost of mismatches balanced.
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 1023) &^ 1023
+	return max(constants.MIN_DELTA_BLOCK_SIZE*1024, min(constants.MAX_DELTA_BLOCK_SIZE*1024, blockSize))
+}
+
+// FileSignatures calculates signatures for all full blocks of given file
+func FileSignatures(filename string, blockSize int) (*Signatures, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	sigs := &Signatures{BlockSize: blockSize}
+	reader := bufio.NewReaderSize(handle, blockSize)
+	block := make([]byte, blockSize)
+
+	for {
+		_, err := io.ReadFull(reader, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Trailing partial block is always sent as literals.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		sigs.Blocks = append(sigs.Blocks, BlockSignature{
+			Weak:   weakChecksum(block),
+			Strong: strongChecksum(block),
+		})
+	}
+
+	return sigs, nil
+}
+
+// StartDelta starts goroutine turning raw file chunks into literals and copy instructions
+func StartDelta(chunks chan []byte, sigs *Signatures, chunkSize int) chan *DeltaOp {
+	out := make(chan *DeltaOp, 2)
+
+	go func() {
+		blockSize := sigs.BlockSize
+
+		// Index blocks by weak checksum.
+		index := make(map[uint32][]int, len(sigs.Blocks))
+		for i, sig := range sigs.Blocks {
+			index[sig.Weak] = append(index[sig.Weak], i)
+		}
+
+		// Copies of adjacent blocks are merged before being passed on.
+		var pendingCopy *DeltaOp
+		flushCopy := func() {
+			if pendingCopy != nil {
+				out <- pendingCopy
+				pendingCopy = nil
+			}
+		}
+		addCopy := func(block int) {
+			offset := uint64(block) * uint64(blockSize)
+			if pendingCopy != nil && pendingCopy.Offset+uint64(pendingCopy.Length) == offset &&
+				int(pendingCopy.Length)+blockSize <= chunkSize {
+				pendingCopy.Length += uint32(blockSize)
+				return
+			}
+			flushCopy()
+			pendingCopy = &DeltaOp{Offset: offset, Length: uint32(blockSize)}
+		}
+		addLiterals := func(data []byte) {
+			if len(data) == 0 {
+				return
+			}
+			flushCopy()
+			out <- &DeltaOp{Data: bytes.Clone(data)}
+		}
+
+		var pending []byte
+		var rolling rollingChecksum
+		var eof, rolled bool
+		i := 0
+
+		for {
+			// Make sure there is a full window plus one byte to roll in.
+			for !eof && len(pending) < i+blockSize+1 {
+				chunk, open := <-chunks
+				if !open {
+					eof = true
+					break
+				}
+				pending = append(pending, chunk...)
+			}
+
+			if len(pending) < i+blockSize {
+				break
+			}
+
+			window := pending[i : i+blockSize]
+			if !rolled {
+				rolling.reset(window)
+				rolled = true
+			}
+
+			if block := findBlock(index, sigs, rolling.sum(), window); block >= 0 {
+				addLiterals(pending[:i])
+				addCopy(block)
+				pending = pending[i+blockSize:]
+				i = 0
+				rolled = false
+				continue
+			}
+
+			if len(pending) == i+blockSize {
+				// Nothing left to roll in.
+				break
+			}
+
+			rolling.roll(pending[i], pending[i+blockSize], blockSize)
+			i++
+
+			if i >= chunkSize {
+				// Enough unmatched data to send as literals.
+				addLiterals(pending[:i])
+				pending = pending[i:]
+				i = 0
+			}
+		}
+
+		// Whatever remains could not be matched.
+		for len(pending) > 0 {
+			n := min(len(pending), chunkSize)
+			addLiterals(pending[:n])
+			pending = pending[n:]
+		}
+		flushCopy()
+
+		close(out)
+	}()
+
+	return out
+}
+
+// findBlock returns index of block matching window or -1 if there's none
+func findBlock(index map[uint32][]int, sigs *Signatures, weak uint32, window []byte) int {
+	candidates, ok := index[weak]
+	if !ok {
+		return -1
+	}
+	strong := strongChecksum(window)
+	for _, block := range candidates {
+		if sigs.Blocks[block].Strong == strong {
+			return block
+		}
+	}
+	return -1
+}
+
+// rollingChecksum is rsync style weak checksum which can be updated one byte at a time
+type rollingChecksum struct {
+	a, b uint32
+}
+
+// reset calculates checksum of given window from scratch
+func (r *rollingChecksum) reset(window []byte) {
+	r.a, r.b = 0, 0
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+}
+
+// roll moves window forward by one byte
+func (r *rollingChecksum) roll(out, in byte, blockSize int) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - uint32(blockSize)*uint32(out)
+}
+
+// sum returns current checksum
+func (r *rollingChecksum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+// weakChecksum returns rolling checksum of given block
+func weakChecksum(block []byte) uint32 {
+	var r rollingChecksum
+	r.reset(block)
+	return r.sum()
+}
+
+// strongChecksum returns truncated SHA256 of given block
+func strongChecksum(block []byte) [16]byte {
+	var strong [16]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+	return strong
+}
@@ -0,0 +1,104 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// applyDelta rebuilds file from basis and delta instructions the way receiving end does
+func applyDelta(t *testing.T, basis []byte, ops chan *DeltaOp) ([]byte, int) {
+	t.Helper()
+	var out []byte
+	var copied int
+	for op := range ops {
+		if op.Data != nil {
+			out = append(out, op.Data...)
+			continue
+		}
+		end := op.Offset + uint64(op.Length)
+		if end > uint64(len(basis)) {
+			t.Fatalf("copy of %d bytes at %d past end of basis", op.Length, op.Offset)
+		}
+		out = append(out, basis[op.Offset:end]...)
+		copied += int(op.Length)
+	}
+	return out, copied
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const blockSize = 1024
+	basis := make([]byte, 64*blockSize+100)
+	rand.Read(basis)
+	inserted := make([]byte, 333)
+	rand.Read(inserted)
+
+	tests := []struct {
+		name       string
+		basis      []byte
+		target     []byte
+		wantCopied int // Least number of bytes expected to be copied from basis
+	}{
+		{"unchanged", basis, basis, 64 * blockSize},
+		{"insert", basis, concat(basis[:10*blockSize+7], inserted, basis[10*blockSize+7:]), 62 * blockSize},
+		{"delete", basis, concat(basis[:5*blockSize], basis[7*blockSize+3:]), 55 * blockSize},
+		{"append", basis, concat(basis, inserted), 64 * blockSize},
+		{"truncated", basis, basis[:20*blockSize+1], 20 * blockSize},
+		{"empty basis", nil, basis, 0},
+		{"empty target", basis, nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "basis")
+			os.WriteFile(filename, test.basis, 0644)
+			sigs, err := FileSignatures(filename, blockSize)
+			if err != nil {
+				t.Fatalf("FileSignatures: %v", err)
+			}
+			if len(sigs.Blocks) != len(test.basis)/blockSize {
+				t.Errorf("%d signatures for %d byte basis", len(sigs.Blocks), len(test.basis))
+			}
+
+			// Target arrives in chunks not aligned with blocks.
+			chunks := make(chan []byte, 4)
+			go func() {
+				for data := test.target; len(data) > 0; {
+					n := min(3000, len(data))
+					chunks <- data[:n]
+					data = data[n:]
+				}
+				close(chunks)
+			}()
+
+			rebuilt, copied := applyDelta(t, test.basis, StartDelta(chunks, sigs, 8*blockSize))
+			if !bytes.Equal(rebuilt, test.target) {
+				t.Errorf("rebuilt %d bytes, want target %d bytes", len(rebuilt), len(test.target))
+			}
+			if copied < test.wantCopied {
+				t.Errorf("copied %d bytes from basis, want at least %d", copied, test.wantCopied)
+			}
+		})
+	}
+}
+
+func TestRollingChecksum(t *testing.T) {
+	data := make([]byte, 5000)
+	rand.Read(data)
+	const window = 1024
+
+	var rolling rollingChecksum
+	rolling.reset(data[:window])
+	for i := 0; i+window < len(data); i++ {
+		rolling.roll(data[i], data[i+window], window)
+		if want := weakChecksum(data[i+1 : i+1+window]); rolling.sum() != want {
+			t.Fatalf("rolled checksum at %d = %x, want %x", i+1, rolling.sum(), want)
+		}
+	}
+}
+
+// concat returns given byte slices joined into new one
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
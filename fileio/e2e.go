@@ -0,0 +1,187 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"go_fast_copy/constants"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// End-to-end encrypted file starts with magic, size of original contents and file key wrapped by master key which
+// only client knows. Every chunk follows as length of frame and frame encrypted with file key. Frame holds codec
+// of chunk and its data compressed as it was sent. Server stores and checks file as-is.
+const (
+	EndToEndMagic     = "GFCE2EE1"
+	endToEndPrefixLen = len(EndToEndMagic) + 8
+	endToEndHeaderLen = endToEndPrefixLen + sealWrappedSize + sealPrefixSize
+)
+
+// EndToEndSealer encrypts chunks of single file
+type EndToEndSealer struct {
+	header []byte
+	aead   cipher.AEAD
+	nonce  []byte
+}
+
+// NewEndToEndSealer creates new random file key for file with original contents of given size
+func NewEndToEndSealer(masterKey []byte, size int64) (*EndToEndSealer, error) {
+	headerPrefix := binary.LittleEndian.AppendUint64([]byte(EndToEndMagic), uint64(size))
+	header, aead, nonce, err := newFileKey(headerPrefix, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EndToEndSealer{header: header, aead: aead, nonce: nonce}, nil
+}
+
+// Seal returns chunk with given sequence number encrypted as it is stored. First chunk carries file header. Last
+// chunk is marked so truncated file can be detected. Safe for concurrent use.
+func (e *EndToEndSealer) Seal(seq uint32, last bool, codec uint16, data []byte) []byte {
+	nonce := append([]byte{}, e.nonce...)
+	segmentNonce(nonce, seq-1, last)
+	plain := binary.LittleEndian.AppendUint16(make([]byte, 0, 2+len(data)), codec)
+	plain = append(plain, data...)
+
+	var out []byte
+	if seq == 1 {
+		out = append(out, e.header...)
+	}
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(plain)+sealTagSize))
+	return e.aead.Seal(out, nonce, plain, nil)
+}
+
+// endToEndReader decrypts and decompresses contents of end-to-end encrypted file
+type endToEndReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	frame   []byte
+	plain   []byte
+	done    bool
+}
+
+// NewEndToEndReader unwraps file key of end-to-end encrypted file with master key. Contents read are original ones.
+func NewEndToEndReader(in io.Reader, masterKey []byte) (io.Reader, error) {
+	reader := bufio.NewReader(in)
+	header := make([]byte, endToEndHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.HasPrefix(header, []byte(EndToEndMagic)) {
+		return nil, errSealed
+	}
+	aead, nonce, err := openFileKey(header, header[:endToEndPrefixLen], masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &endToEndReader{in: reader, aead: aead, nonce: nonce}, nil
+}
+
+// Read returns original contents one chunk at a time. Error is returned if any chunk fails authentication or last
+// one is missing.
+func (e *endToEndReader) Read(p []byte) (int, error) {
+	for len(e.plain) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.plain)
+	e.plain = e.plain[n:]
+	return n, nil
+}
+
+// open reads, decrypts and decompresses next chunk
+func (e *endToEndReader) open() error {
+	var length uint32
+	if err := binary.Read(e.in, binary.LittleEndian, &length); err != nil {
+		// Last chunk was never written.
+		return errSealed
+	}
+	if length < 2+sealTagSize || length > constants.MAX_CLIENT_CHUNK_SIZE*1024*2 {
+		return errSealed
+	}
+	if cap(e.frame) < int(length) {
+		e.frame = make([]byte, length)
+	}
+	e.frame = e.frame[:length]
+	if _, err := io.ReadFull(e.in, e.frame); err != nil {
+		return errSealed
+	}
+	_, err := e.in.Peek(1)
+	last := err == io.EOF
+
+	segmentNonce(e.nonce, e.counter, last)
+	e.counter++
+	plain, err := e.aead.Open(e.frame[:0], e.nonce, e.frame, nil)
+	if err != nil {
+		return errSealed
+	}
+	switch binary.LittleEndian.Uint16(plain) {
+	case constants.CODEC_NONE:
+		e.plain = plain[2:]
+	case constants.CODEC_LZ4:
+		if e.plain, err = DecompressChunk(plain[2:], nil); err != nil {
+			return errSealed
+		}
+	default:
+		return errors.New("chunk is compressed with unsupported codec")
+	}
+	e.done = last
+	return nil
+}
+
+// NameCipher encrypts file names so that same name always gives same result
+type NameCipher struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+// NewNameCipher derives key for encrypting names from master key
+func NewNameCipher(masterKey []byte) (*NameCipher, error) {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("GFC file names"))
+	key := mac.Sum(nil)
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &NameCipher{key: key, aead: aead}, nil
+}
+
+// Encrypt encrypts every folder and file name of path separately so files stay in their folders. Nonce is derived
+// from name itself.
+func (n *NameCipher) Encrypt(name string) string {
+	parts := strings.Split(name, string(filepath.Separator))
+	for i, part := range parts {
+		mac := hmac.New(sha256.New, n.key)
+		mac.Write([]byte(part))
+		nonce := mac.Sum(nil)[:sealNonceSize]
+		parts[i] = base64.RawURLEncoding.EncodeToString(n.aead.Seal(nonce, nonce, []byte(part), nil))
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+// Decrypt returns original path of path encrypted with Encrypt
+func (n *NameCipher) Decrypt(name string) (string, error) {
+	parts := strings.Split(filepath.Clean(name), string(filepath.Separator))
+	for i, part := range parts {
+		sealed, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil || len(sealed) < sealNonceSize {
+			return "", errSealed
+		}
+		plain, err := n.aead.Open(nil, sealed[:sealNonceSize], sealed[sealNonceSize:], nil)
+		if err != nil {
+			return "", errSealed
+		}
+		parts[i] = string(plain)
+	}
+	return strings.Join(parts, string(filepath.Separator)), nil
+}
@@ -0,0 +1,156 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"go_fast_copy/constants"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealEndToEnd returns file as server stores it when chunks are sent encrypted end-to-end with given key
+func sealEndToEnd(t *testing.T, chunks [][]byte, key []byte) []byte {
+	t.Helper()
+	var size int
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	sealer, err := NewEndToEndSealer(key, int64(size))
+	if err != nil {
+		t.Fatalf("NewEndToEndSealer: %v", err)
+	}
+	out := new(bytes.Buffer)
+	for i, chunk := range chunks {
+		data, codec := CompressChunk(chunk, nil)
+		out.Write(sealer.Seal(uint32(i+1), i == len(chunks)-1, codec, data))
+	}
+	return out.Bytes()
+}
+
+func TestEndToEndRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	random := make([]byte, 200*1024)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("end to end "), 10000)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"empty chunk", [][]byte{{}}},
+		{"compressible", [][]byte{text}},
+		{"incompressible", [][]byte{random}},
+		{"mixed chunks", [][]byte{text, random, text[:10], random[:3]}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored := sealEndToEnd(t, test.chunks, key)
+			original := bytes.Join(test.chunks, nil)
+
+			reader, err := NewEndToEndReader(bytes.NewReader(stored), key)
+			if err != nil {
+				t.Fatalf("NewEndToEndReader: %v", err)
+			}
+			plain, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading encrypted file: %v", err)
+			}
+			if !bytes.Equal(plain, original) {
+				t.Errorf("read %d bytes, want original %d bytes", len(plain), len(original))
+			}
+		})
+	}
+}
+
+func TestEndToEndDetectsTampering(t *testing.T) {
+	key := newTestKey(t)
+	chunks := [][]byte{bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 1000)}
+	stored := sealEndToEnd(t, chunks, key)
+	// File holding only first chunk tells where second one starts.
+	first := sealEndToEnd(t, chunks[:1], key)
+
+	flipped := append([]byte{}, stored...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"other key", stored, newTestKey(t)},
+		{"flipped bit", flipped, key},
+		{"truncated", stored[:len(stored)-5], key},
+		{"last chunk dropped", stored[:len(first)], key},
+		{"no header", stored[endToEndHeaderLen:], key},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewEndToEndReader(bytes.NewReader(test.data), test.key)
+			if err == nil {
+				_, err = io.ReadAll(reader)
+			}
+			if err == nil {
+				t.Errorf("tampered file was read without error")
+			}
+		})
+	}
+}
+
+func TestNameCipher(t *testing.T) {
+	names, err := NewNameCipher(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewNameCipher(newTestKey(t))
+
+	tests := []string{
+		"file.txt",
+		filepath.Join("folder", "sub folder", "file"),
+		strings.Repeat("long", 50),
+		"ünïcödé",
+	}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			encrypted := names.Encrypt(name)
+			if encrypted != names.Encrypt(name) {
+				t.Errorf("same name gave different encrypted names")
+			}
+			if strings.Count(encrypted, string(filepath.Separator)) != strings.Count(name, string(filepath.Separator)) {
+				t.Errorf("encrypted name %q does not keep folders", encrypted)
+			}
+			if strings.Contains(encrypted, filepath.Base(name)) {
+				t.Errorf("encrypted name %q contains original name", encrypted)
+			}
+			decrypted, err := names.Decrypt(encrypted)
+			if err != nil || decrypted != name {
+				t.Errorf("Decrypt = %q, %v", decrypted, err)
+			}
+			if _, err := other.Decrypt(encrypted); err == nil {
+				t.Errorf("name was decrypted with other key")
+			}
+		})
+	}
+
+	if _, err := names.Decrypt("not encrypted"); err == nil {
+		t.Errorf("name which was never encrypted was decrypted")
+	}
+}
+
+func TestEndToEndCodecs(t *testing.T) {
+	key := newTestKey(t)
+	sealer, err := NewEndToEndSealer(key, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := sealer.Seal(1, true, constants.CODEC_LZ4_DICT, []byte("data"))
+
+	reader, err := NewEndToEndReader(bytes.NewReader(stored), key)
+	if err != nil {
+		t.Fatalf("NewEndToEndReader: %v", err)
+	}
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Errorf("chunk compressed with dictionary was read without error")
+	}
+}
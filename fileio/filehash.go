@@ -2,61 +2,113 @@ package fileio
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"go_fast_copy/constants"
 	"hash"
 	"hash/crc32"
 	"io"
 	"os"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
 )
 
-// GetFileChecksumSHA256 returns SHA256 checksum of given file
-func GetFileChecksumSHA256(file string) []byte {
-	handle, err := os.Open(file)
-	if err != nil {
-		fmt.Println(err.Error())
-		return make([]byte, 32)
+// hashAlgorithm describes checksum algorithm known by both client and server
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+// hashes is registry of supported checksum algorithms indexed by their identifier
+var hashes = map[uint8]hashAlgorithm{
+	constants.HASH_CRC32:      {"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	constants.HASH_SHA256:     {"sha256", sha256.New},
+	constants.HASH_XXH3:       {"xxh3", func() hash.Hash { return &xxh3Hash{xxh3.New()} }},
+	constants.HASH_BLAKE3:     {"blake3", func() hash.Hash { return blake3.New(32, nil) }},
+	constants.HASH_SHA512_256: {"sha512-256", sha512.New512_256},
+}
+
+// xxh3Hash makes xxHash3 hasher return its 128-bit variant
+type xxh3Hash struct {
+	*xxh3.Hasher
+}
+
+func (x *xxh3Hash) Size() int { return 16 }
+
+func (x *xxh3Hash) Sum(b []byte) []byte {
+	sum := x.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+// NewHash returns new hash for given algorithm or nil if it's not supported
+func NewHash(algorithm uint8) hash.Hash {
+	if alg, ok := hashes[algorithm]; ok {
+		return alg.new()
 	}
-	defer handle.Close()
+	return nil
+}
 
-	hash := sha256.New()
-	if _, err := io.CopyBuffer(hash, handle, make([]byte, 64*1024)); err != nil {
-		fmt.Println(err.Error())
-		return make([]byte, 32)
+// HashName returns name of given algorithm
+func HashName(algorithm uint8) string {
+	if alg, ok := hashes[algorithm]; ok {
+		return alg.name
 	}
+	return "none"
+}
 
-	return hash.Sum(nil)
+// HashByName returns identifier of algorithm with given name
+func HashByName(name string) (uint8, bool) {
+	for id, alg := range hashes {
+		if alg.name == name {
+			return id, true
+		}
+	}
+	return constants.HASH_NONE, false
 }
 
-// progressiveChecksumSHA256 incrementally calculates SHA256 checksum
-func progressiveChecksumSHA256(shaHash hash.Hash, data []byte) hash.Hash {
-	if shaHash == nil {
-		shaHash = sha256.New()
+// HashNames returns names of all supported algorithms
+func HashNames() []string {
+	names := make([]string, 0, len(hashes))
+	for id := uint8(0); len(names) < len(hashes); id++ {
+		if alg, ok := hashes[id]; ok {
+			names = append(names, alg.name)
+		}
 	}
-	if len(data) > 0 {
-		shaHash.Write(data)
+	return names
+}
+
+// SupportedHashes returns bitmask of supported algorithms
+func SupportedHashes() uint16 {
+	var mask uint16
+	for id := range hashes {
+		mask |= 1 << id
 	}
-	return shaHash
+	return mask
 }
 
-// GetFileChecksumCRC32 returns CRC32 checksum of given file
-func GetFileChecksumCRC32(file string) []byte {
+// GetFileChecksum returns checksum of given file using given algorithm
+func GetFileChecksum(file string, algorithm uint8) []byte {
 	handle, err := os.Open(file)
 	if err != nil {
 		fmt.Println(err.Error())
-		return make([]byte, 4)
+		return nil
 	}
 	defer handle.Close()
 
-	hash := crc32.New(crc32.IEEETable)
-	if _, err := io.CopyBuffer(hash, handle, make([]byte, 64*1024)); err != nil {
+	return GetChecksum(handle, algorithm)
+}
+
+// GetChecksum returns checksum of all data from given reader using given algorithm
+func GetChecksum(reader io.Reader, algorithm uint8) []byte {
+	hash := NewHash(algorithm)
+	if hash == nil {
+		return nil
+	}
+	if _, err := io.CopyBuffer(hash, reader, make([]byte, 64*1024)); err != nil {
 		fmt.Println(err.Error())
-		return make([]byte, 4)
+		return nil
 	}
 
 	return hash.Sum(nil)
 }
-
-// progressiveChecksumCRC32 incrementally calculates CRC32 checksum
-func progressiveChecksumCRC32(hash uint32, data []byte) uint32 {
-	return crc32.Update(hash, crc32.IEEETable, data)
-}
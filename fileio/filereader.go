@@ -1,6 +1,8 @@
 package fileio
 
 type FileReader interface {
-	New(filename string, chunkSize, numchunks int) error
-	StartReading() chan []byte
+	New(filename string, chunkSize, numchunks int, algorithm uint8) error
+	UseTree(blockSize int)
+	StartReading() (chan []byte, chan []byte)
+	Tree() *MerkleTree
 }
@@ -1,6 +1,9 @@
 package fileio
 
 type FileWriter interface {
-	New(filename string, bufferSize, qlen int, sha bool) error
+	New(filename string, bufferSize, qlen int, algorithm uint8) error
+	UseTree(blockSize int)
 	StartWriting() (chan []byte, chan []byte)
+	Tree() *MerkleTree
+	Size() int64
 }
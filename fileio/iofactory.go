@@ -5,13 +5,17 @@ type IOFactory interface {
 	NewWriter() FileWriter
 }
 
-// BufferedFactory is the default factory returning buffered reader/writer instances
-type BufferedFactory struct{}
+// BufferedFactory is the default factory returning buffered reader/writer instances. Files are written encrypted
+// if key is set. If packed, files are written as frames returned by PackChunk.
+type BufferedFactory struct {
+	Key    []byte
+	Packed bool
+}
 
 func (b *BufferedFactory) NewReader() FileReader {
 	return new(BufferedReader)
 }
 
 func (b *BufferedFactory) NewWriter() FileWriter {
-	return new(BufferedWriter)
+	return &BufferedWriter{key: b.Key, packed: b.Packed}
 }
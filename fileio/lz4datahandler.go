@@ -1,45 +1,71 @@
 package fileio
 
 import (
+	"errors"
 	"go_fast_copy/constants"
 
 	"github.com/pierrec/lz4/v4"
 )
 
-// CompressChunk attempts to compress a chunk in LZ4 and either returns original or compressed chunk
-func CompressChunk(chunk []byte) ([]byte, bool) {
+// CompressionOptions control how chunks get compressed
+type CompressionOptions struct {
+	Level      int    // 0 for fast compression, 1-9 for high compression
+	Dictionary []byte // Optional dictionary shared with receiving end
+}
+
+// CompressChunk attempts to compress a chunk in LZ4 and either returns original or compressed chunk with its codec
+func CompressChunk(chunk []byte, options *CompressionOptions) ([]byte, uint16) {
+	codec := uint16(constants.CODEC_LZ4)
+
 	// Attempt to compress.
-	compressedSize, compressed := compress(chunk)
+	compressedSize, compressed := compress(chunk, options)
+
+	if options != nil && len(options.Dictionary) > 0 {
+		// Dictionary is only worth it if it beats compressing without one.
+		dictSize, dictCompressed := compressWithDict(chunk, options.Dictionary)
+		if dictSize > 0 && (compressedSize == 0 || dictSize < compressedSize) {
+			compressedSize, compressed = dictSize, dictCompressed
+			codec = constants.CODEC_LZ4_DICT
+		}
+	}
 
 	if compressedSize == 0 || compressedSize >= len(chunk) {
 		// Chunk was not compressible.
-		return chunk, false
+		return chunk, constants.CODEC_NONE
 	} else {
 		// Chunk was compressed.
-		return compressed[:compressedSize], true
+		return compressed[:compressedSize], codec
 	}
 }
 
-// DecompressChunk returns uncompressed data of given chunk
-func DecompressChunk(chunk []byte) []byte {
-	return uncompress(chunk)
+// DecompressChunk returns uncompressed data of given chunk or error if chunk could not be decompressed
+func DecompressChunk(chunk []byte, dictionary []byte) ([]byte, error) {
+	return uncompress(chunk, dictionary)
 }
 
 // uncompress uncompresses chunk and returns resulting slice of uncompressed bytes
-func uncompress(block []byte) []byte {
+func uncompress(block []byte, dictionary []byte) ([]byte, error) {
 	buffer := make([]byte, constants.MAX_CLIENT_CHUNK_SIZE*1024)
-	actual, err := lz4.UncompressBlock(block, buffer)
+	actual, err := lz4.UncompressBlockWithDict(block, buffer, dictionary)
 	if err != nil {
-		panic("protocol error: client sent data which uncompressed exceeds the maximum allowed size")
+		return nil, errors.New("protocol error: chunk is corrupted or uncompressed exceeds the maximum allowed size")
 	}
-	return buffer[:actual]
+	return buffer[:actual], nil
 }
 
 // compress compresses chunk and returns resulting chunk and # of bytes compressed if any
-func compress(block []byte) (int, []byte) {
+func compress(block []byte, options *CompressionOptions) (int, []byte) {
 	buffer := make([]byte, lz4.CompressBlockBound(len(block)))
-	var c lz4.Compressor
-	compressed, err := c.CompressBlock(block, buffer)
+	var compressed int
+	var err error
+	if options != nil && options.Level > 0 {
+		// High compression mode trades speed for ratio.
+		c := lz4.CompressorHC{Level: lz4.CompressionLevel(1 << (8 + options.Level))}
+		compressed, err = c.CompressBlock(block, buffer)
+	} else {
+		var c lz4.Compressor
+		compressed, err = c.CompressBlock(block, buffer)
+	}
 	if err != nil {
 		return 0, block
 	}
@@ -0,0 +1,224 @@
+package fileio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go_fast_copy/constants"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	minMatch     = 4     // Shortest match LZ4 can encode
+	mfLimit      = 12    // Last match must start this many bytes before end of block
+	lastLiterals = 5     // Last bytes of block are always literals
+	maxOffset    = 65535 // Furthest LZ4 can reach back
+	hashLog      = 16    // Size of match finder hash table
+	segmentLen   = 32    // Length of segments considered for dictionary
+)
+
+// LoadDictionary reads dictionary from file keeping at most the maximum allowed size from its end
+func LoadDictionary(filename string) ([]byte, error) {
+	dict, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(dict) > constants.MAX_DICTIONARY_SIZE*1024 {
+		dict = dict[len(dict)-constants.MAX_DICTIONARY_SIZE*1024:]
+	}
+	return dict, nil
+}
+
+// SampleFiles reads the beginning of each given file to be used as dictionary training samples
+func SampleFiles(files []string, sampleSize, maxSamples int) [][]byte {
+	samples := make([][]byte, 0, min(len(files), maxSamples))
+	for _, file := range files {
+		if len(samples) >= maxSamples {
+			break
+		}
+		handle, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		sample := make([]byte, sampleSize)
+		read, _ := io.ReadFull(handle, sample)
+		handle.Close()
+		if read > 0 {
+			samples = append(samples, sample[:read])
+		}
+	}
+	return samples
+}
+
+// TrainDictionary builds dictionary of given size out of segments most commonly shared between samples
+func TrainDictionary(samples [][]byte, size int) []byte {
+	type segment struct {
+		data  []byte
+		count int
+	}
+
+	segments := make(map[uint64]*segment)
+
+	for _, sample := range samples {
+		// Count each segment only once per sample so segments common across files win.
+		seen := make(map[uint64]bool)
+		for i := 0; i+segmentLen <= len(sample); i += segmentLen / 4 {
+			hash := fnv.New64a()
+			hash.Write(sample[i : i+segmentLen])
+			key := hash.Sum64()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if seg, ok := segments[key]; ok {
+				seg.count++
+			} else {
+				segments[key] = &segment{data: sample[i : i+segmentLen], count: 1}
+			}
+		}
+	}
+
+	ranked := make([]*segment, 0, len(segments))
+	for _, seg := range segments {
+		if seg.count > 1 {
+			ranked = append(ranked, seg)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		// Ties are broken by contents so same samples always give same dictionary.
+		if ranked[i].count != ranked[j].count {
+			return ranked[i].count > ranked[j].count
+		}
+		return bytes.Compare(ranked[i].data, ranked[j].data) < 0
+	})
+
+	if len(ranked)*segmentLen > size {
+		ranked = ranked[:size/segmentLen]
+	}
+
+	// Most common segments go last so they are reachable with shortest offsets.
+	dict := make([]byte, 0, size)
+	for i := len(ranked) - 1; i >= 0; i-- {
+		dict = append(dict, ranked[i].data...)
+	}
+
+	if len(dict) == 0 {
+		// Nothing in common between samples. Fall back to raw sample data.
+		for _, sample := range samples {
+			dict = append(dict, sample...)
+		}
+		if len(dict) > size {
+			dict = dict[len(dict)-size:]
+		}
+	}
+
+	return dict
+}
+
+// compressWithDict compresses chunk as LZ4 block allowing matches to reference dictionary preceding it
+func compressWithDict(block, dict []byte) (int, []byte) {
+	if len(block) <= mfLimit {
+		return 0, block
+	}
+	if len(dict) > maxOffset {
+		dict = dict[len(dict)-maxOffset:]
+	}
+
+	// Dictionary and chunk are treated as one continuous window.
+	window := make([]byte, 0, len(dict)+len(block))
+	window = append(append(window, dict...), block...)
+	start := len(dict)
+	end := len(window)
+	matchLimit := end - lastLiterals
+
+	table := make([]int32, 1<<hashLog)
+	for i := range table {
+		table[i] = -1
+	}
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(window[i:]) * 2654435761) >> (32 - hashLog)
+	}
+
+	// Index dictionary contents.
+	for i := 0; i+minMatch <= start; i++ {
+		table[hash(i)] = int32(i)
+	}
+
+	buffer := make([]byte, lz4.CompressBlockBound(len(block)))
+	anchor := start
+	di := 0
+
+	for i := start; i < end-mfLimit; {
+		h := hash(i)
+		ref := int(table[h])
+		table[h] = int32(i)
+
+		if ref < 0 || i-ref > maxOffset ||
+			binary.LittleEndian.Uint32(window[ref:]) != binary.LittleEndian.Uint32(window[i:]) {
+			i++
+			continue
+		}
+
+		// Extend match as far as possible.
+		matchLen := minMatch
+		for i+matchLen < matchLimit && window[ref+matchLen] == window[i+matchLen] {
+			matchLen++
+		}
+
+		di = putSequence(buffer, di, window[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+
+	// Remaining bytes are emitted as literals.
+	di = putSequence(buffer, di, window[anchor:end], 0, 0)
+
+	return di, buffer
+}
+
+// putSequence writes LZ4 sequence of literals followed by optional match and returns new position
+func putSequence(dst []byte, di int, literals []byte, offset, matchLen int) int {
+	token := di
+	di++
+
+	var t byte
+	if len(literals) < 15 {
+		t = byte(len(literals) << 4)
+	} else {
+		t = 0xF0
+		di = putLength(dst, di, len(literals)-15)
+	}
+	di += copy(dst[di:], literals)
+
+	if offset > 0 {
+		dst[di] = byte(offset)
+		dst[di+1] = byte(offset >> 8)
+		di += 2
+
+		matchLen -= minMatch
+		if matchLen < 15 {
+			t |= byte(matchLen)
+		} else {
+			t |= 0x0F
+			di = putLength(dst, di, matchLen-15)
+		}
+	}
+
+	dst[token] = t
+	return di
+}
+
+// putLength writes LZ4 variable length integer and returns new position
+func putLength(dst []byte, di, length int) int {
+	for length >= 255 {
+		dst[di] = 255
+		di++
+		length -= 255
+	}
+	dst[di] = byte(length)
+	return di + 1
+}
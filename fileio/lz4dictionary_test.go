@@ -0,0 +1,113 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"go_fast_copy/constants"
+	"testing"
+)
+
+// logSamples returns samples resembling log files which share most of their lines
+func logSamples(count int) [][]byte {
+	samples := make([][]byte, count)
+	for i := range samples {
+		sample := new(bytes.Buffer)
+		for line := 0; line < 200; line++ {
+			fmt.Fprintf(sample, "level=INFO msg=\"Received client request\" session=%d line=%d status=ok\n", i, line)
+		}
+		samples[i] = sample.Bytes()
+	}
+	return samples
+}
+
+func TestCompressWithDictRoundTrip(t *testing.T) {
+	dictionary := TrainDictionary(logSamples(8), 4096)
+	random := make([]byte, 4096)
+	rand.Read(random)
+	long := bytes.Repeat([]byte{1}, maxOffset+1000)
+
+	tests := []struct {
+		name       string
+		chunk      []byte
+		dictionary []byte
+	}{
+		{"similar to samples", logSamples(9)[8], dictionary},
+		{"short of dictionary", []byte("level=INFO msg=\"Received client request\""), dictionary},
+		{"random", random, dictionary},
+		{"dictionary beyond reach", []byte("some data which is found in dictionary"),
+			append([]byte("some data which is found in dictionary"), long...)},
+		{"no dictionary", logSamples(1)[0], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size, data := compressWithDict(test.chunk, test.dictionary)
+			if size == 0 {
+				t.Fatalf("chunk of %d bytes was not compressed", len(test.chunk))
+			}
+			raw, err := DecompressChunk(data[:size], test.dictionary)
+			if err != nil {
+				t.Fatalf("DecompressChunk: %v", err)
+			}
+			if !bytes.Equal(raw, test.chunk) {
+				t.Errorf("DecompressChunk returned %d bytes, want original %d bytes", len(raw), len(test.chunk))
+			}
+		})
+	}
+}
+
+func TestCompressChunkWithDictionary(t *testing.T) {
+	samples := logSamples(8)
+	options := &CompressionOptions{Dictionary: TrainDictionary(samples, 4096)}
+	chunk := []byte("level=INFO msg=\"Received client request\" session=3 line=7 status=ok\n")
+
+	data, codec := CompressChunk(chunk, options)
+	if codec != constants.CODEC_LZ4_DICT {
+		t.Fatalf("chunk sharing lines with dictionary was sent with codec %d", codec)
+	}
+	if raw, err := DecompressChunk(data, options.Dictionary); err != nil || !bytes.Equal(raw, chunk) {
+		t.Errorf("DecompressChunk returned %q, error %v", raw, err)
+	}
+	if _, err := DecompressChunk(data, nil); err == nil {
+		t.Errorf("chunk referring to dictionary was decompressed without it")
+	}
+}
+
+func TestShortChunkIsNotCompressedWithDict(t *testing.T) {
+	if size, _ := compressWithDict([]byte("tiny"), []byte("tiny tiny tiny")); size != 0 {
+		t.Errorf("chunk too short for LZ4 match was compressed to %d bytes", size)
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	random := make([][]byte, 4)
+	for i := range random {
+		random[i] = make([]byte, 1000)
+		rand.Read(random[i])
+	}
+
+	tests := []struct {
+		name    string
+		samples [][]byte
+		size    int
+	}{
+		{"common lines", logSamples(8), 4096},
+		{"smaller than common lines", logSamples(8), 100},
+		{"nothing in common", random, 2500},
+		{"no samples", nil, 4096},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dictionary := TrainDictionary(test.samples, test.size)
+			if len(dictionary) > test.size {
+				t.Errorf("dictionary of %d bytes exceeds size %d", len(dictionary), test.size)
+			}
+			if len(test.samples) > 0 && len(dictionary) == 0 {
+				t.Errorf("dictionary is empty")
+			}
+			if again := TrainDictionary(test.samples, test.size); !bytes.Equal(again, dictionary) {
+				t.Errorf("same samples gave different dictionary")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package fileio
+
+import (
+	"io"
+
+	"lukechampine.com/blake3"
+)
+
+// MerkleTree is hash tree over fixed-size blocks of file. Level 0 holds hashes of blocks.
+type MerkleTree struct {
+	blockSize int
+	size      uint64
+	leaf      *blake3.Hasher
+	filled    int
+	levels    [][][32]byte
+}
+
+// NewMerkleTree returns empty tree to be built by writing file contents to it
+func NewMerkleTree(blockSize int) *MerkleTree {
+	m := &MerkleTree{blockSize: blockSize, levels: make([][][32]byte, 1)}
+	m.startLeaf()
+	return m
+}
+
+// BuildMerkleTree returns tree over all data from given reader
+func BuildMerkleTree(reader io.Reader, blockSize int) (*MerkleTree, error) {
+	m := NewMerkleTree(blockSize)
+	if _, err := io.CopyBuffer(m, reader, make([]byte, 64*1024)); err != nil {
+		return nil, err
+	}
+	m.Finish()
+	return m, nil
+}
+
+// startLeaf starts hashing next block. Leaves and nodes are prefixed differently so one can't pass for another.
+func (m *MerkleTree) startLeaf() {
+	m.leaf = blake3.New(32, nil)
+	m.leaf.Write([]byte{0})
+	m.filled = 0
+}
+
+// endLeaf adds hash of current block to tree
+func (m *MerkleTree) endLeaf() {
+	var sum [32]byte
+	m.leaf.Sum(sum[:0])
+	m.levels[0] = append(m.levels[0], sum)
+	m.startLeaf()
+}
+
+// Write adds data to tree
+func (m *MerkleTree) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		n := min(m.blockSize-m.filled, len(data))
+		m.leaf.Write(data[:n])
+		m.filled += n
+		data = data[n:]
+		if m.filled == m.blockSize {
+			m.endLeaf()
+		}
+	}
+	m.size += uint64(written)
+	return written, nil
+}
+
+// Finish hashes last partial block and builds upper levels of tree
+func (m *MerkleTree) Finish() {
+	if m.filled > 0 || len(m.levels[0]) == 0 {
+		m.endLeaf()
+	}
+	for level := m.levels[0]; len(level) > 1; {
+		next := make([][32]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// Odd node is promoted as is.
+				next = append(next, level[i])
+				continue
+			}
+			node := blake3.New(32, nil)
+			node.Write([]byte{1})
+			node.Write(level[i][:])
+			node.Write(level[i+1][:])
+			var sum [32]byte
+			node.Sum(sum[:0])
+			next = append(next, sum)
+		}
+		m.levels = append(m.levels, next)
+		level = next
+	}
+}
+
+// Root returns hash at top of tree
+func (m *MerkleTree) Root() [32]byte {
+	return m.levels[len(m.levels)-1][0]
+}
+
+// Height returns level of root
+func (m *MerkleTree) Height() int {
+	return len(m.levels) - 1
+}
+
+// Size returns number of bytes tree was built over
+func (m *MerkleTree) Size() uint64 {
+	return m.size
+}
+
+// Node returns hash at given level and index
+func (m *MerkleTree) Node(level int, index uint32) ([32]byte, bool) {
+	if level < 0 || level >= len(m.levels) || int(index) >= len(m.levels[level]) {
+		return [32]byte{}, false
+	}
+	return m.levels[level][index], true
+}
+
+// Block returns offset and length of block with given leaf index
+func (m *MerkleTree) Block(leaf uint32) (uint64, int) {
+	offset := uint64(leaf) * uint64(m.blockSize)
+	return offset, int(min(uint64(m.blockSize), m.size-offset))
+}
+
+// Diff walks down from root comparing nodes with another tree of same size and returns leaves which differ.
+// Nodes of other tree at given level are obtained with query.
+func (m *MerkleTree) Diff(query func(level int, indexes []uint32) [][32]byte) []uint32 {
+	differing := []uint32{0}
+	for level := m.Height() - 1; level >= 0; level-- {
+		children := make([]uint32, 0, len(differing)*2)
+		for _, parent := range differing {
+			for child := parent * 2; child <= parent*2+1 && int(child) < len(m.levels[level]); child++ {
+				children = append(children, child)
+			}
+		}
+		other := query(level, children)
+		if len(other) != len(children) {
+			return nil
+		}
+		differing = differing[:0]
+		for i, child := range children {
+			if m.levels[level][child] != other[i] {
+				differing = append(differing, child)
+			}
+		}
+	}
+	return differing
+}
@@ -0,0 +1,104 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"slices"
+	"testing"
+)
+
+// treeQuery returns query answering with nodes of given tree as remote end would
+func treeQuery(tree *MerkleTree) func(level int, indexes []uint32) [][32]byte {
+	return func(level int, indexes []uint32) [][32]byte {
+		nodes := make([][32]byte, len(indexes))
+		for i, index := range indexes {
+			nodes[i], _ = tree.Node(level, index)
+		}
+		return nodes
+	}
+}
+
+func TestMerkleDiff(t *testing.T) {
+	const blockSize = 1024
+
+	tests := []struct {
+		name    string
+		size    int
+		corrupt []int // Offsets of corrupted bytes
+		want    []uint32
+	}{
+		{"identical", 8 * blockSize, nil, []uint32{}},
+		{"first block", 8 * blockSize, []int{0}, []uint32{0}},
+		{"middle block", 8 * blockSize, []int{5*blockSize + 17}, []uint32{5}},
+		{"two blocks", 8 * blockSize, []int{blockSize, 6 * blockSize}, []uint32{1, 6}},
+		{"odd last block", 6*blockSize + 100, []int{6*blockSize + 99}, []uint32{6}},
+		{"next to odd block", 6*blockSize + 100, []int{5 * blockSize}, []uint32{5}},
+		{"single block", 100, []int{50}, []uint32{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.Read(data)
+			corrupted := bytes.Clone(data)
+			for _, offset := range test.corrupt {
+				corrupted[offset] ^= 1
+			}
+
+			tree, err := BuildMerkleTree(bytes.NewReader(data), blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := BuildMerkleTree(bytes.NewReader(corrupted), blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tree.Root() == other.Root()) != (len(test.corrupt) == 0) {
+				t.Errorf("roots equal = %v with %d corrupted bytes", tree.Root() == other.Root(), len(test.corrupt))
+			}
+			if len(test.corrupt) == 0 {
+				// Nothing to walk down to once roots match.
+				return
+			}
+
+			differing := tree.Diff(treeQuery(other))
+			if !slices.Equal(differing, test.want) {
+				t.Errorf("Diff = %v, want %v", differing, test.want)
+			}
+			for _, leaf := range differing {
+				offset, length := tree.Block(leaf)
+				if int(offset)+length > test.size {
+					t.Errorf("block %d at %d of %d bytes past end of file", leaf, offset, length)
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleDiffShortAnswer(t *testing.T) {
+	tree, _ := BuildMerkleTree(bytes.NewReader(make([]byte, 4096)), 1024)
+	differing := tree.Diff(func(level int, indexes []uint32) [][32]byte {
+		return nil
+	})
+	if differing != nil {
+		t.Errorf("Diff = %v when other end gave no nodes", differing)
+	}
+}
+
+func TestMerkleTreeWrites(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.Read(data)
+	whole, _ := BuildMerkleTree(bytes.NewReader(data), 1024)
+
+	// Tree does not depend on how data is split into writes.
+	pieces := NewMerkleTree(1024)
+	for i := 0; i < len(data); i += 333 {
+		pieces.Write(data[i:min(i+333, len(data))])
+	}
+	pieces.Finish()
+	if pieces.Root() != whole.Root() || pieces.Size() != whole.Size() || pieces.Height() != whole.Height() {
+		t.Errorf("tree written in pieces differs from tree written at once")
+	}
+	if offset, length := whole.Block(9); offset != 9*1024 || length != 10000-9*1024 {
+		t.Errorf("Block(9) = %d, %d", offset, length)
+	}
+}
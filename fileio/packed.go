@@ -0,0 +1,196 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"go_fast_copy/constants"
+	"io"
+)
+
+// PackMagic identifies files stored as frames of chunks compressed as they were received
+const PackMagic = "GFCPACK1\n"
+
+// PackedFrame is header of single chunk of packed file. Data of chunk follows header.
+type PackedFrame struct {
+	Codec  uint16 // Either CODEC_NONE or CODEC_LZ4
+	Length uint32 // Length of original data
+	Stored uint32 // Length of data following header
+}
+
+var errPacked = errors.New("packed file is corrupted")
+
+// PackChunk returns frame of chunk as it is stored. LZ4 compressed chunks are stored without decompressing them.
+// Chunks compressed with session dictionary are compressed again without one as dictionary is not stored.
+func PackChunk(data []byte, codec uint16, dictionary []byte) ([]byte, error) {
+	frame := PackedFrame{Codec: codec, Length: uint32(len(data)), Stored: uint32(len(data))}
+	switch codec {
+	case constants.CODEC_NONE:
+	case constants.CODEC_LZ4:
+		length, err := lz4BlockSize(data)
+		if err != nil {
+			return nil, err
+		}
+		frame.Length = uint32(length)
+	case constants.CODEC_LZ4_DICT:
+		if dictionary == nil {
+			return nil, errors.New("chunk is compressed with dictionary which is not available")
+		}
+		raw, err := DecompressChunk(data, dictionary)
+		if err != nil {
+			return nil, err
+		}
+		data, frame.Codec = CompressChunk(raw, nil)
+		frame.Length, frame.Stored = uint32(len(raw)), uint32(len(data))
+	default:
+		return nil, errors.New("unknown codec")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, binary.Size(frame)+len(data)))
+	binary.Write(out, binary.LittleEndian, &frame)
+	out.Write(data)
+	return out.Bytes(), nil
+}
+
+// UnpackChunk returns original data of frame returned by PackChunk
+func UnpackChunk(frame []byte) ([]byte, error) {
+	var header PackedFrame
+	size := binary.Size(header)
+	binary.Read(bytes.NewReader(frame), binary.LittleEndian, &header)
+	if header.Codec == constants.CODEC_LZ4 {
+		return DecompressChunk(frame[size:], nil)
+	}
+	return frame[size:], nil
+}
+
+// AppendOriginal returns frame returned by PackChunk followed by original data of chunk, so writer can calculate
+// checksum of original data without unpacking frame again
+func AppendOriginal(frame, raw []byte) []byte {
+	return append(frame, raw...)
+}
+
+// SplitFrame returns frame returned by PackChunk and original data appended to it by AppendOriginal if any
+func SplitFrame(chunk []byte) ([]byte, []byte) {
+	end := binary.Size(PackedFrame{}) + int(binary.LittleEndian.Uint32(chunk[6:]))
+	return chunk[:end], chunk[end:]
+}
+
+// PackedLength returns length of original data of frame returned by PackChunk
+func PackedLength(frame []byte) int {
+	return int(binary.LittleEndian.Uint32(frame[2:]))
+}
+
+// lz4BlockSize walks sequences of LZ4 block and returns length of its original data without decompressing it.
+// Error is returned if block could not be decompressed.
+func lz4BlockSize(block []byte) (int, error) {
+	var pos, length int
+	limit := constants.MAX_CLIENT_CHUNK_SIZE * 1024
+	// extend adds bytes following 15 in token to length.
+	extend := func(value int) (int, bool) {
+		for {
+			if pos >= len(block) {
+				return 0, false
+			}
+			next := block[pos]
+			pos++
+			value += int(next)
+			if next != 255 {
+				return value, true
+			}
+		}
+	}
+
+	for {
+		if pos >= len(block) {
+			return 0, errPacked
+		}
+		token := block[pos]
+		pos++
+
+		literals, ok := int(token>>4), true
+		if literals == 15 {
+			literals, ok = extend(literals)
+		}
+		pos += literals
+		length += literals
+		if !ok || pos > len(block) || length > limit {
+			return 0, errPacked
+		}
+		if pos == len(block) {
+			// Last sequence has only literals.
+			return length, nil
+		}
+
+		if pos+2 > len(block) {
+			return 0, errPacked
+		}
+		offset := int(block[pos]) | int(block[pos+1])<<8
+		pos += 2
+		if offset == 0 || offset > length {
+			return 0, errPacked
+		}
+		match := int(token & 15)
+		if match == 15 {
+			match, ok = extend(match)
+		}
+		length += match + 4
+		if !ok || length > limit {
+			return 0, errPacked
+		}
+	}
+}
+
+// packReader reads original contents of packed file
+type packReader struct {
+	in    *bufio.Reader
+	frame []byte
+	plain []byte
+}
+
+// NewPackReader returns reader of original contents of packed file
+func NewPackReader(in io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(in)
+	if magic, _ := reader.Peek(len(PackMagic)); !bytes.Equal(magic, []byte(PackMagic)) {
+		return nil, errPacked
+	}
+	reader.Discard(len(PackMagic))
+	return &packReader{in: reader}, nil
+}
+
+// Read returns decompressed contents one chunk at a time
+func (p *packReader) Read(data []byte) (int, error) {
+	for len(p.plain) == 0 {
+		var header PackedFrame
+		if err := binary.Read(p.in, binary.LittleEndian, &header); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil || header.Stored > constants.MAX_CLIENT_CHUNK_SIZE*1024 {
+			return 0, errPacked
+		}
+		if cap(p.frame) < int(header.Stored) {
+			p.frame = make([]byte, header.Stored)
+		}
+		p.frame = p.frame[:header.Stored]
+		if _, err := io.ReadFull(p.in, p.frame); err != nil {
+			return 0, errPacked
+		}
+
+		switch header.Codec {
+		case constants.CODEC_NONE:
+			p.plain = p.frame
+		case constants.CODEC_LZ4:
+			if length, err := lz4BlockSize(p.frame); err != nil || length != int(header.Length) {
+				return 0, errPacked
+			}
+			var err error
+			if p.plain, err = DecompressChunk(p.frame, nil); err != nil {
+				return 0, errPacked
+			}
+		default:
+			return 0, errPacked
+		}
+	}
+	n := copy(data, p.plain)
+	p.plain = p.plain[n:]
+	return n, nil
+}
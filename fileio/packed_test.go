@@ -0,0 +1,145 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"go_fast_copy/constants"
+	"io"
+	"testing"
+)
+
+func TestPackRoundTrip(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("go fast copy packs chunks as they arrive "), 4096)
+	dictionary := bytes.Repeat([]byte("go fast copy "), 64)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		codec  uint16 // Codec chunks are sent with
+	}{
+		{"uncompressed", [][]byte{random, text[:1000]}, constants.CODEC_NONE},
+		{"lz4", [][]byte{text, text[:5000]}, constants.CODEC_LZ4},
+		{"lz4 with dictionary", [][]byte{text, text[:777]}, constants.CODEC_LZ4_DICT},
+		{"no chunks", nil, constants.CODEC_LZ4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packed := bytes.NewBufferString(PackMagic)
+			var original []byte
+			for _, chunk := range test.chunks {
+				data := chunk
+				switch test.codec {
+				case constants.CODEC_LZ4:
+					data = compressBlock(t, chunk, nil)
+				case constants.CODEC_LZ4_DICT:
+					data = compressBlock(t, chunk, dictionary)
+				}
+				frame, err := PackChunk(data, test.codec, dictionary)
+				if err != nil {
+					t.Fatalf("PackChunk: %v", err)
+				}
+				if PackedLength(frame) != len(chunk) {
+					t.Errorf("PackedLength = %d, want %d", PackedLength(frame), len(chunk))
+				}
+				if unpacked, err := UnpackChunk(frame); err != nil || !bytes.Equal(unpacked, chunk) {
+					t.Errorf("UnpackChunk does not return original chunk, error %v", err)
+				}
+				packed.Write(frame)
+				original = append(original, chunk...)
+			}
+
+			reader, err := NewPackReader(packed)
+			if err != nil {
+				t.Fatalf("NewPackReader: %v", err)
+			}
+			contents, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading packed file: %v", err)
+			}
+			if !bytes.Equal(contents, original) {
+				t.Errorf("read %d bytes, want original %d bytes", len(contents), len(original))
+			}
+		})
+	}
+}
+
+func TestSplitFrame(t *testing.T) {
+	chunk := bytes.Repeat([]byte("abc"), 1000)
+	frame, err := PackChunk(compressBlock(t, chunk, nil), constants.CODEC_LZ4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		chunk    []byte
+		original []byte
+	}{
+		{"frame only", frame, nil},
+		{"frame with original", AppendOriginal(append([]byte{}, frame...), chunk), chunk},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotFrame, gotOriginal := SplitFrame(test.chunk)
+			if !bytes.Equal(gotFrame, frame) {
+				t.Errorf("frame differs from the one packed")
+			}
+			if !bytes.Equal(gotOriginal, test.original) {
+				t.Errorf("original data is %d bytes, want %d", len(gotOriginal), len(test.original))
+			}
+		})
+	}
+}
+
+func TestPackReaderRejectsCorruption(t *testing.T) {
+	frame, err := PackChunk(compressBlock(t, bytes.Repeat([]byte("abc"), 1000), nil), constants.CODEC_LZ4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongLength := append([]byte{}, frame...)
+	wrongLength[2]++
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated frame", append([]byte(PackMagic), frame[:len(frame)-1]...)},
+		{"wrong original length", append([]byte(PackMagic), wrongLength...)},
+		{"truncated header", append([]byte(PackMagic), frame[:4]...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewPackReader(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("NewPackReader: %v", err)
+			}
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Errorf("corrupted packed file was read without error")
+			}
+		})
+	}
+
+	if _, err := NewPackReader(bytes.NewReader(frame)); err == nil {
+		t.Errorf("file without magic was accepted")
+	}
+}
+
+// compressBlock compresses chunk as client would send it, with dictionary if given
+func compressBlock(t *testing.T, chunk, dictionary []byte) []byte {
+	t.Helper()
+	if dictionary != nil {
+		size, data := compressWithDict(chunk, dictionary)
+		if size == 0 {
+			t.Fatalf("test chunk of %d bytes is not compressible", len(chunk))
+		}
+		return data[:size]
+	}
+	data, codec := CompressChunk(chunk, nil)
+	if codec == constants.CODEC_NONE {
+		t.Fatalf("test chunk of %d bytes is not compressible", len(chunk))
+	}
+	return data
+}
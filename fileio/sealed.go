@@ -0,0 +1,246 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"go_fast_copy/constants"
+	"io"
+	"os"
+	"strings"
+)
+
+// Sealed file starts with magic, random file key wrapped by master key and nonce prefix of segments. Contents
+// follow in segments encrypted with file key. Nonce of each segment holds its number and whether it's the last
+// one so segments can't be reordered, dropped or truncated without notice.
+const (
+	SealMagic       = "GFCSEAL1"
+	sealNonceSize   = 12
+	sealKeySize     = 32
+	sealTagSize     = 16
+	sealPrefixSize  = 7
+	sealWrappedSize = sealNonceSize + sealKeySize + sealTagSize
+	sealHeaderSize  = len(SealMagic) + sealWrappedSize + sealPrefixSize
+	sealSegmentSize = constants.SEAL_SEGMENT_SIZE * 1024
+)
+
+var errSealed = errors.New("sealed file is corrupted, truncated or encrypted with another key")
+
+// LoadKey reads 256-bit master key from file containing either 32 raw bytes or 64 hex characters
+func LoadKey(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == sealKeySize {
+		return key, nil
+	}
+	if len(data) == sealKeySize {
+		return data, nil
+	}
+	return nil, errors.New("key file must contain 32 bytes or 64 hex characters")
+}
+
+// newGCM returns AES-GCM cipher with given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWriter encrypts everything written to it in segments
+type sealWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+}
+
+// newFileKey returns header starting with given prefix which holds new random file key wrapped by master key and
+// nonce prefix of segments. Header prefix is authenticated along with file key. Cipher of file key and nonce of
+// first segment are returned.
+func newFileKey(headerPrefix, masterKey []byte) ([]byte, cipher.AEAD, []byte, error) {
+	header := append(append([]byte{}, headerPrefix...), make([]byte, sealNonceSize)...)
+	fileKey := make([]byte, sealKeySize)
+	prefix := make([]byte, sealPrefixSize)
+	if _, err := rand.Read(header[len(headerPrefix):]); err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, nil, nil, err
+	}
+
+	wrap, err := newGCM(masterKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header = wrap.Seal(header, header[len(headerPrefix):], fileKey, headerPrefix)
+	header = append(header, prefix...)
+
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return header, aead, append(prefix, make([]byte, sealNonceSize-sealPrefixSize)...), nil
+}
+
+// openFileKey unwraps file key from header following given header prefix with master key. Cipher of file key and
+// nonce of first segment are returned.
+func openFileKey(header, headerPrefix, masterKey []byte) (cipher.AEAD, []byte, error) {
+	wrap, err := newGCM(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped := header[len(headerPrefix) : len(headerPrefix)+sealWrappedSize]
+	fileKey, err := wrap.Open(nil, wrapped[:sealNonceSize], wrapped[sealNonceSize:], headerPrefix)
+	if err != nil {
+		return nil, nil, errSealed
+	}
+
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := header[len(headerPrefix)+sealWrappedSize:]
+	return aead, append(append([]byte{}, prefix...), make([]byte, sealNonceSize-sealPrefixSize)...), nil
+}
+
+// NewSealWriter writes header of sealed file with new random file key wrapped by master key. Contents written are
+// encrypted until writer is closed. Underlying writer is not closed.
+func NewSealWriter(out io.Writer, masterKey []byte) (io.WriteCloser, error) {
+	header, aead, nonce, err := newFileKey([]byte(SealMagic), masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = out.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		out:   out,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, sealSegmentSize),
+	}, nil
+}
+
+// Write encrypts every full segment. Last segment is only encrypted once writer is closed.
+func (s *sealWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		if len(s.buf) == sealSegmentSize {
+			if err := s.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		n := min(sealSegmentSize-len(s.buf), len(data))
+		s.buf = append(s.buf, data[:n]...)
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// Close encrypts last segment
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+// seal encrypts buffered segment and writes it out
+func (s *sealWriter) seal(last bool) error {
+	segmentNonce(s.nonce, s.counter, last)
+	s.counter++
+	_, err := s.out.Write(s.aead.Seal(nil, s.nonce, s.buf, nil))
+	s.buf = s.buf[:0]
+	return err
+}
+
+// segmentNonce sets number of segment and whether it's the last one to nonce
+func segmentNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[sealPrefixSize:], counter)
+	nonce[sealNonceSize-1] = 0
+	if last {
+		nonce[sealNonceSize-1] = 1
+	}
+}
+
+// sealReader decrypts contents of sealed file
+type sealReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	segment []byte
+	plain   []byte
+	done    bool
+}
+
+// NewSealReader reads header of sealed file and unwraps its file key with master key. Contents read are decrypted.
+func NewSealReader(in io.Reader, masterKey []byte) (io.Reader, error) {
+	reader := bufio.NewReader(in)
+	header := make([]byte, sealHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.HasPrefix(header, []byte(SealMagic)) {
+		return nil, errSealed
+	}
+
+	aead, nonce, err := openFileKey(header, []byte(SealMagic), masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealReader{
+		in:      reader,
+		aead:    aead,
+		nonce:   nonce,
+		segment: make([]byte, sealSegmentSize+sealTagSize),
+	}, nil
+}
+
+// Read returns decrypted contents. Error is returned if any segment fails authentication or last one is missing.
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts next segment
+func (s *sealReader) open() error {
+	n, err := io.ReadFull(s.in, s.segment)
+	if err == io.EOF {
+		// Last segment was never written.
+		return errSealed
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// Only last segment may be shorter than others. If it's full size, nothing follows it.
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, err = s.in.Peek(1)
+		last = err == io.EOF
+	}
+
+	segmentNonce(s.nonce, s.counter, last)
+	s.counter++
+	s.plain, err = s.aead.Open(s.segment[:0], s.nonce, s.segment[:n], nil)
+	if err != nil {
+		return errSealed
+	}
+	s.done = last
+	return nil
+}
@@ -0,0 +1,135 @@
+package fileio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKey returns random master key
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// sealContents returns contents encrypted at rest with given key, written in pieces of given size
+func sealContents(t *testing.T, contents, key []byte, piece int) []byte {
+	t.Helper()
+	out := new(bytes.Buffer)
+	writer, err := NewSealWriter(out, key)
+	if err != nil {
+		t.Fatalf("NewSealWriter: %v", err)
+	}
+	for data := contents; len(data) > 0; {
+		n := min(piece, len(data))
+		if _, err := writer.Write(data[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		data = data[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	random := make([]byte, 3*sealSegmentSize+5)
+	rand.Read(random)
+
+	tests := []struct {
+		name  string
+		size  int
+		piece int // Size of writes
+	}{
+		{"empty", 0, 1},
+		{"single byte", 1, 1},
+		{"short of segment", sealSegmentSize - 1, 1000},
+		{"exactly one segment", sealSegmentSize, sealSegmentSize},
+		{"just over segment", sealSegmentSize + 1, 7777},
+		{"several segments", len(random), 100000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contents := random[:test.size]
+			sealed := sealContents(t, contents, key, test.piece)
+			if bytes.Contains(sealed, contents) && test.size > 16 {
+				t.Errorf("sealed file contains original contents")
+			}
+
+			reader, err := NewSealReader(bytes.NewReader(sealed), key)
+			if err != nil {
+				t.Fatalf("NewSealReader: %v", err)
+			}
+			plain, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading sealed file: %v", err)
+			}
+			if !bytes.Equal(plain, contents) {
+				t.Errorf("read %d bytes, want original %d bytes", len(plain), len(contents))
+			}
+		})
+	}
+}
+
+func TestSealDetectsTampering(t *testing.T) {
+	key := newTestKey(t)
+	contents := bytes.Repeat([]byte("sealed "), sealSegmentSize/2)
+	sealed := sealContents(t, contents, key, len(contents))
+	firstSegment := sealHeaderSize + sealSegmentSize + sealTagSize
+
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"other key", sealed, newTestKey(t)},
+		{"flipped bit", flipped, key},
+		{"last segment dropped", sealed[:firstSegment], key},
+		{"truncated segment", sealed[:len(sealed)-10], key},
+		{"truncated header", sealed[:sealHeaderSize-1], key},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewSealReader(bytes.NewReader(test.data), test.key)
+			if err == nil {
+				_, err = io.ReadAll(reader)
+			}
+			if err == nil {
+				t.Errorf("tampered file was read without error")
+			}
+		})
+	}
+}
+
+func TestOpenStoredSealed(t *testing.T) {
+	key := newTestKey(t)
+	contents := []byte("contents encrypted at rest")
+	filename := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(filename, sealContents(t, contents, key, len(contents)), 0644)
+
+	reader, err := OpenStored(filename, FormatSealed, nil, key)
+	if err != nil {
+		t.Fatalf("OpenStored: %v", err)
+	}
+	plain, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(plain, contents) {
+		t.Errorf("read %q, error %v", plain, err)
+	}
+
+	if _, err := OpenStored(filename, FormatSealed, nil, nil); err == nil {
+		t.Errorf("sealed file was opened without key")
+	}
+}
@@ -0,0 +1,172 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"go_fast_copy/constants"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Formats files may be stored in instead of their original contents
+const (
+	FormatPlain    = ""         // Original contents
+	FormatManifest = "manifest" // List of chunks in chunk store
+	FormatSealed   = "sealed"   // Encrypted at rest
+	FormatPacked   = "packed"   // Chunks compressed as received
+)
+
+// formatRecord tells how file is stored. Record only applies while file has size and modification time it had once
+// stored, so files replaced by other means are read as they are.
+type formatRecord struct {
+	Path    string `json:"path"`
+	Format  string `json:"format,omitempty"`
+	Size    int64  `json:"size"`   // Size of original contents
+	Stored  int64  `json:"stored"` // Size of file as stored
+	ModTime int64  `json:"mtime"`
+}
+
+// FormatIndex records how files under root folder are stored, so format never has to be guessed from contents
+// which clients control. Files stored as received with nothing else to record are left out.
+type FormatIndex struct {
+	folder  string
+	lock    sync.Mutex
+	entries map[string]*formatRecord
+	lines   int // Records in index, including ones overridden since
+}
+
+// NewFormatIndex returns index of files stored under given folder
+func NewFormatIndex(folder string) *FormatIndex {
+	return &FormatIndex{folder: folder}
+}
+
+// Lookup returns format file is stored in and size of its original contents
+func (f *FormatIndex) Lookup(filename string, info os.FileInfo) (string, int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.load()
+	record := f.entries[f.key(filename)]
+	if record == nil || record.Stored != info.Size() || record.ModTime != info.ModTime().UnixNano() {
+		return FormatPlain, info.Size()
+	}
+	return record.Format, record.Size
+}
+
+// Record remembers format of file which has just been stored along with size of its original contents
+func (f *FormatIndex) Record(filename, format string, size int64) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	record := &formatRecord{
+		Path:    f.key(filename),
+		Format:  format,
+		Size:    size,
+		Stored:  info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.load()
+	if !record.needed() {
+		if f.entries[record.Path] == nil {
+			return nil
+		}
+		// Record is still written so earlier one no longer applies.
+		delete(f.entries, record.Path)
+	} else {
+		f.entries[record.Path] = record
+	}
+
+	if f.lines-len(f.entries) >= sidecarSlack {
+		return f.compact()
+	}
+	index, err := os.OpenFile(filepath.Join(f.folder, constants.FormatIndex), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	line, _ := json.Marshal(record)
+	if _, err = index.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.lines++
+	return nil
+}
+
+// needed returns true if file can't be read as it is stored
+func (r *formatRecord) needed() bool {
+	return r.Format != FormatPlain || r.Size != r.Stored
+}
+
+// key returns path of file relative to folder of index
+func (f *FormatIndex) key(filename string) string {
+	if relative, err := filepath.Rel(f.folder, filename); err == nil {
+		return filepath.ToSlash(relative)
+	}
+	return filepath.ToSlash(filename)
+}
+
+// load reads index once. Later records override earlier ones for the same file. Index is rewritten without
+// overridden records and records of files which have since changed or been removed.
+func (f *FormatIndex) load() {
+	if f.entries != nil {
+		return
+	}
+	f.entries = make(map[string]*formatRecord)
+
+	data, err := os.ReadFile(filepath.Join(f.folder, constants.FormatIndex))
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		record := new(formatRecord)
+		if json.Unmarshal(scanner.Bytes(), record) == nil && record.Path != "" {
+			if record.needed() {
+				f.entries[record.Path] = record
+			} else {
+				delete(f.entries, record.Path)
+			}
+		}
+		f.lines++
+	}
+
+	for path, record := range f.entries {
+		info, err := os.Stat(filepath.Join(f.folder, filepath.FromSlash(path)))
+		if err != nil || record.Stored != info.Size() || record.ModTime != info.ModTime().UnixNano() {
+			delete(f.entries, path)
+		}
+	}
+	if f.lines > len(f.entries) {
+		f.compact()
+	}
+}
+
+// compact rewrites index with only current records. New index replaces old one only once written.
+func (f *FormatIndex) compact() error {
+	buffer := new(bytes.Buffer)
+	for _, record := range f.entries {
+		line, _ := json.Marshal(record)
+		buffer.Write(append(line, '\n'))
+	}
+	path := filepath.Join(f.folder, constants.FormatIndex)
+	temp, err := os.CreateTemp(f.folder, constants.FormatIndex+".*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(buffer.Bytes())
+	temp.Close()
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	f.lines = len(f.entries)
+	return nil
+}
@@ -0,0 +1,105 @@
+package fileio
+
+import (
+	"bytes"
+	"go_fast_copy/constants"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		size       int64
+		change     func(filename string) // Changes file by other means after it was recorded
+		wantFormat string
+		wantSize   int64
+	}{
+		{"plain", FormatPlain, 10, nil, FormatPlain, 10},
+		{"packed", FormatPacked, 1000, nil, FormatPacked, 1000},
+		{"plain with declared size", FormatPlain, 4, nil, FormatPlain, 4},
+		{"replaced", FormatSealed, 1000, func(filename string) {
+			os.WriteFile(filename, []byte("something else"), 0644)
+		}, FormatPlain, 14},
+		{"touched", FormatManifest, 1000, func(filename string) {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(filename, later, later)
+		}, FormatPlain, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "sub", "file")
+			os.MkdirAll(filepath.Dir(filename), 0755)
+			os.WriteFile(filename, []byte("0123456789"), 0644)
+
+			if err := NewFormatIndex(dir).Record(filename, test.format, test.size); err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+			if test.change != nil {
+				test.change(filename)
+			}
+
+			// Index is read again from disk.
+			info, _ := os.Stat(filename)
+			format, size := NewFormatIndex(dir).Lookup(filename, info)
+			if format != test.wantFormat || size != test.wantSize {
+				t.Errorf("Lookup = %q, %d, want %q, %d", format, size, test.wantFormat, test.wantSize)
+			}
+		})
+	}
+}
+
+func TestFormatIndexOnlyKeepsNeededRecords(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	os.WriteFile(filename, []byte("contents"), 0644)
+	index := NewFormatIndex(dir)
+
+	index.Record(filename, FormatPlain, 8)
+	if _, err := os.Stat(filepath.Join(dir, constants.FormatIndex)); err == nil {
+		t.Errorf("index was written for file stored as received")
+	}
+
+	index.Record(filename, FormatPacked, 100)
+	// File stored as received again replaces earlier record.
+	index.Record(filename, FormatPlain, 8)
+	info, _ := os.Stat(filename)
+	if format, size := NewFormatIndex(dir).Lookup(filename, info); format != FormatPlain || size != 8 {
+		t.Errorf("Lookup = %q, %d after file was stored as received", format, size)
+	}
+
+	for i := 0; i < sidecarSlack; i++ {
+		index.Record(filename, FormatPacked, int64(i))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, constants.FormatIndex))
+	if lines := strings.Count(string(data), "\n"); lines >= sidecarSlack {
+		t.Errorf("index holds %d records of single file", lines)
+	}
+}
+
+func TestOpenStoredIgnoresContents(t *testing.T) {
+	// Files stored as received are read as they are whatever they start with.
+	tests := []string{ManifestMagic, SealMagic, PackMagic, EndToEndMagic}
+	for _, magic := range tests {
+		t.Run(strings.TrimSpace(magic), func(t *testing.T) {
+			contents := []byte(magic + "contents sent by client")
+			filename := filepath.Join(t.TempDir(), "file")
+			os.WriteFile(filename, contents, 0644)
+
+			reader, err := OpenStored(filename, FormatPlain, nil, nil)
+			if err != nil {
+				t.Fatalf("OpenStored: %v", err)
+			}
+			defer reader.Close()
+			if read, _ := io.ReadAll(reader); !bytes.Equal(read, contents) {
+				t.Errorf("read %q, want %q", read, contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package fileio
+
+import (
+	"bufio"
+	"hash"
+	"io"
+)
+
+// StreamFactory returns reader and writer of streams such as standard input and output instead of files
+type StreamFactory struct {
+	Source io.Reader
+	Target io.Writer
+}
+
+func (s *StreamFactory) NewReader() FileReader {
+	return &StreamReader{source: s.Source}
+}
+
+func (s *StreamFactory) NewWriter() FileWriter {
+	return &StreamWriter{target: s.Target}
+}
+
+// StreamReader reads data of unknown length from stream
+type StreamReader struct {
+	source    io.Reader
+	chunkSize int
+	rqLen     int
+	hash      hash.Hash
+	tree      *MerkleTree
+}
+
+// New prepares to read stream. File name is ignored.
+func (s *StreamReader) New(filename string, chunkSize, numchunks int, algorithm uint8) error {
+	s.hash = NewHash(algorithm)
+	s.chunkSize = chunkSize
+	s.rqLen = numchunks
+	return nil
+}
+
+// UseTree makes reader build hash tree over blocks of given size while reading
+func (s *StreamReader) UseTree(blockSize int) {
+	s.tree = NewMerkleTree(blockSize)
+}
+
+// Tree returns hash tree of stream contents once all of it has been read
+func (s *StreamReader) Tree() *MerkleTree {
+	return s.tree
+}
+
+// StartReading starts a goroutine to read stream in chunks until it ends. Checksum of contents follows once read.
+func (s *StreamReader) StartReading() (chan []byte, chan []byte) {
+	hash := make(chan []byte, 1)
+	outChan := make(chan []byte, s.rqLen)
+	go func(channel chan []byte, result chan []byte) {
+		for {
+			buf := make([]byte, s.chunkSize)
+			// Pipes return whatever is available so fill the whole chunk.
+			read, err := io.ReadFull(s.source, buf)
+			if read > 0 {
+				if s.hash != nil {
+					s.hash.Write(buf[:read])
+				}
+				if s.tree != nil {
+					s.tree.Write(buf[:read])
+				}
+				channel <- buf[:read]
+			}
+			if err != nil {
+				// Stream has ended.
+				break
+			}
+		}
+		close(outChan)
+
+		if s.tree != nil {
+			s.tree.Finish()
+		}
+
+		if s.hash != nil {
+			result <- s.hash.Sum(nil)
+		} else {
+			result <- nil
+		}
+		close(result)
+	}(outChan, hash)
+	return outChan, hash
+}
+
+// StreamWriter writes data to stream. Stream is left open so several files can be written one after another.
+type StreamWriter struct {
+	target io.Writer
+	writer *bufio.Writer
+	wqLen  int
+	hash   hash.Hash
+	tree   *MerkleTree
+	size   int64
+}
+
+// New prepares to write to stream. File name is ignored.
+func (s *StreamWriter) New(filename string, bufferSize, qlen int, algorithm uint8) error {
+	s.hash = NewHash(algorithm)
+	s.writer = bufio.NewWriterSize(s.target, bufferSize)
+	s.wqLen = qlen
+	return nil
+}
+
+// UseTree makes writer build hash tree over blocks of given size while writing
+func (s *StreamWriter) UseTree(blockSize int) {
+	s.tree = NewMerkleTree(blockSize)
+}
+
+// Tree returns hash tree of stream contents once all of it has been written
+func (s *StreamWriter) Tree() *MerkleTree {
+	return s.tree
+}
+
+// Size returns size of stream contents once all of it has been written
+func (s *StreamWriter) Size() int64 {
+	return s.size
+}
+
+// StartWriting starts goroutine for writing chunks of data to stream
+func (s *StreamWriter) StartWriting() (chan []byte, chan []byte) {
+	hash := make(chan []byte)
+	stream := make(chan []byte, s.wqLen)
+	go func(chunkStream chan []byte, result chan []byte) {
+		for chunk := range chunkStream {
+			s.writer.Write(chunk)
+			s.size += int64(len(chunk))
+
+			if s.hash != nil {
+				s.hash.Write(chunk)
+			}
+			if s.tree != nil {
+				s.tree.Write(chunk)
+			}
+		}
+
+		s.writer.Flush()
+
+		var bytes []byte
+
+		if s.tree != nil {
+			s.tree.Finish()
+		}
+
+		if s.hash != nil {
+			bytes = s.hash.Sum(nil)
+		}
+
+		// Signal that all data has been written.
+		hash <- bytes
+		close(hash)
+	}(stream, hash)
+	return stream, hash
+}
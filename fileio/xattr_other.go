@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd)
+
+package fileio
+
+import "errors"
+
+var errNoXattr = errors.New("extended attributes not supported")
+
+// getXattr returns value of extended attribute of file
+func getXattr(filename, name string) ([]byte, error) {
+	return nil, errNoXattr
+}
+
+// setXattr sets value of extended attribute of file
+func setXattr(filename, name string, value []byte) error {
+	return errNoXattr
+}
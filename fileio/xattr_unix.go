@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package fileio
+
+import "golang.org/x/sys/unix"
+
+// getXattr returns value of extended attribute of file
+func getXattr(filename, name string) ([]byte, error) {
+	buf := make([]byte, 512)
+	size, err := unix.Getxattr(filename, name, buf)
+	if err == unix.ERANGE {
+		// Value does not fit. Ask for its size first.
+		if size, err = unix.Getxattr(filename, name, nil); err == nil {
+			buf = make([]byte, size)
+			size, err = unix.Getxattr(filename, name, buf)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// setXattr sets value of extended attribute of file
+func setXattr(filename, name string, value []byte) error {
+	return unix.Setxattr(filename, name, value, 0)
+}
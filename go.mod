@@ -6,8 +6,12 @@ toolchain go1.23.3
 
 require (
 	github.com/akamensky/argparse v1.4.0
+	github.com/klauspost/compress v1.18.0
 	github.com/pierrec/lz4/v4 v4.1.22
+	github.com/zeebo/xxh3 v1.1.0
 	golang.org/x/net v0.41.0
+	golang.org/x/sys v0.33.0
+	lukechampine.com/blake3 v1.4.1
 )
 
-require golang.org/x/sys v0.33.0 // indirect
+require github.com/klauspost/cpuid/v2 v2.2.10 // indirect
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is value which only ever increases
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Add increases counter by given amount
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Inc increases counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Gauge is value which may go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+// Set sets gauge to given value
+func (g *Gauge) Set(n int64) {
+	g.value.Store(n)
+}
+
+// Add adds given amount, which may be negative, to gauge
+func (g *Gauge) Add(n int64) {
+	g.value.Add(n)
+}
+
+// Timer keeps total time spent on and number of operations
+type Timer struct {
+	nanos atomic.Uint64
+	count atomic.Uint64
+}
+
+// Observe records single operation which took given time
+func (t *Timer) Observe(took time.Duration) {
+	t.nanos.Add(uint64(took))
+	t.count.Add(1)
+}
+
+// Metrics of server
+var (
+	SessionsActive     Gauge   // Clients currently connected
+	Sessions           Counter // Clients connected since start
+	ReceivedCompressed Counter // File data received as sent by clients
+	ReceivedRaw        Counter // File data received after decompression
+	FilesCompleted     Counter // Files received and stored
+	ChecksumMismatches Counter // Files whose checksum did not match the one sent by client
+	AuthFailures       Counter // Clients which failed authentication
+	MuxerBuffered      Gauge   // Chunks buffered by muxer until ones before them arrive
+	WriteQueue         Gauge   // Chunks waiting in write queue of file writer
+)
+
+var (
+	workers     = make(map[int]*Timer)
+	workersLock sync.Mutex
+)
+
+// Decompression returns timer of decompression done by worker with given index
+func Decompression(worker int) *Timer {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+	timer := workers[worker]
+	if timer == nil {
+		timer = new(Timer)
+		workers[worker] = timer
+	}
+	return timer
+}
+
+// Serve serves metrics on given address under /metrics. Returns only on error.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// Write writes all metrics in Prometheus text exposition format
+func Write(out io.Writer) {
+	family(out, "gfc_sessions_active", "gauge", "Clients currently connected.")
+	sample(out, "gfc_sessions_active", "", SessionsActive.value.Load())
+	family(out, "gfc_sessions_total", "counter", "Clients connected since server started.")
+	sample(out, "gfc_sessions_total", "", Sessions.value.Load())
+	family(out, "gfc_received_bytes_total", "counter", "File data received, as sent by clients and after decompression.")
+	sample(out, "gfc_received_bytes_total", `kind="compressed"`, ReceivedCompressed.value.Load())
+	sample(out, "gfc_received_bytes_total", `kind="raw"`, ReceivedRaw.value.Load())
+	family(out, "gfc_files_completed_total", "counter", "Files received and stored.")
+	sample(out, "gfc_files_completed_total", "", FilesCompleted.value.Load())
+	family(out, "gfc_checksum_mismatches_total", "counter", "Files whose checksum did not match the one sent by client.")
+	sample(out, "gfc_checksum_mismatches_total", "", ChecksumMismatches.value.Load())
+	family(out, "gfc_auth_failures_total", "counter", "Clients which failed authentication.")
+	sample(out, "gfc_auth_failures_total", "", AuthFailures.value.Load())
+	family(out, "gfc_muxer_buffered_chunks", "gauge", "Out-of-order chunks buffered until ones before them arrive.")
+	sample(out, "gfc_muxer_buffered_chunks", "", MuxerBuffered.value.Load())
+	family(out, "gfc_write_queue_chunks", "gauge", "Chunks waiting in write queue of file writer.")
+	sample(out, "gfc_write_queue_chunks", "", WriteQueue.value.Load())
+
+	workersLock.Lock()
+	indexes := make([]int, 0, len(workers))
+	for index := range workers {
+		indexes = append(indexes, index)
+	}
+	workersLock.Unlock()
+	sort.Ints(indexes)
+
+	family(out, "gfc_worker_decompression_seconds_total", "counter", "Time workers spent decompressing chunks.")
+	for _, index := range indexes {
+		seconds := float64(Decompression(index).nanos.Load()) / float64(time.Second)
+		sample(out, "gfc_worker_decompression_seconds_total", `worker="`+strconv.Itoa(index)+`"`, seconds)
+	}
+	family(out, "gfc_worker_decompressed_chunks_total", "counter", "Chunks decompressed by workers.")
+	for _, index := range indexes {
+		sample(out, "gfc_worker_decompressed_chunks_total", `worker="`+strconv.Itoa(index)+`"`,
+			Decompression(index).count.Load())
+	}
+}
+
+// family writes help and type of metric
+func family(out io.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes single value of metric with optional labels
+func sample(out io.Writer, name, labels string, value interface{}) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintln(out, name, value)
+}
@@ -11,15 +11,87 @@ type AuthBlock struct {
 	// Followed by len * byte payload.
 }
 
+// Capabilities is optional payload of opcode 1 response describing what server supports
+type Capabilities struct {
+	Codecs uint16 // Bitmask of supported chunk compression codecs
+	Hashes uint16 // Bitmask of supported checksum algorithms
+}
+
+// DictionaryBlock is payload of opcode 5 request announcing compression dictionary
+type DictionaryBlock struct {
+	Checksum uint32 // CRC32 of dictionary
+	BlockLen uint32 // Dictionary length
+	// Followed by len * byte payload.
+}
+
 // DataStreamChunk opcode 3 describes an individual chunk in TCP stream
 type DataStreamChunk struct {
 	Sequence    uint32 // Sequence number of the chunk (starts from 1)
-	Compression uint16 // Is the chunk compressed
+	Compression uint16 // Compression codec of the chunk
 	DataLength  uint32 // Chunk len
 	// Followed by len * byte payload.
 }
 
+// VerifiedStreamChunk opcode 3 describes chunk sent with CHUNK_VERIFIED flag, which carries checksum of its payload
+type VerifiedStreamChunk struct {
+	DataStreamChunk
+	Checksum uint32 // CRC32C of chunk payload
+	// Followed by len * byte payload.
+}
+
+// ChunkNack is payload of opcode 8 asking client to send chunk again
+type ChunkNack struct {
+	Sequence uint32 // Sequence number of chunk which failed verification
+}
+
+// BlockCopy is payload of opcode 3 chunk referring to range of file already existing on server
+type BlockCopy struct {
+	Offset uint64 // Offset in existing file
+	Length uint32 // Number of bytes to copy
+}
+
+// ChunkReference is payload of opcode 3 chunk referring to chunk already in server chunk store
+type ChunkReference struct {
+	Hash   [32]byte // SHA256 of chunk
+	Length uint32   // Chunk length
+}
+
+// SignatureBlock opcode 6 carries block signatures of file already existing on server
+type SignatureBlock struct {
+	BlockSize uint32 // Size of each signed block
+	Count     uint16 // Number of signatures in this message
+	// Followed by count * fileio.BlockSignature.
+}
+
+// ChunkQuery opcode 7 asks which of the chunks server already has in its chunk store
+type ChunkQuery struct {
+	Count uint16 // Number of hashes in this message
+	// Followed by count * [32]byte SHA256 hashes. Response payload is bitmap of chunks present.
+}
+
 // EndFileTransfer opcode 4 contains file checksum for comparison
 type EndFileTransfer struct {
-	Checksum [32]byte // CRC32/SHA256 checksum
+	Checksum [32]byte // File checksum
+	Root     [32]byte // Root of hash tree over file blocks if one was built
+	Size     uint64   // File size
+}
+
+// TreeInfo is response to opcode 9 describing hash tree of file on server
+type TreeInfo struct {
+	Root [32]byte // Root of hash tree
+	Size uint64   // File size
+}
+
+// TreeQuery opcode 10 asks for nodes of hash tree on server at given level
+type TreeQuery struct {
+	Level uint8  // Tree level (0: blocks)
+	Count uint16 // Number of nodes in this message
+	// Followed by count * uint32 node indexes. Response payload is count * [32]byte hashes.
+}
+
+// BlockRepair opcode 11 replaces corrupted block of file on server
+type BlockRepair struct {
+	Offset uint64 // Block offset in file
+	Length uint32 // Block length
+	// Followed by len * byte payload.
 }
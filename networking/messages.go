@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 )
 
+// castagnoli is CRC32C table used for chunk checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // Header contains static message parts
 type Header struct {
 	Opcode uint8
@@ -20,6 +24,13 @@ type Packet struct {
 	Payload []byte
 }
 
+// ChunkMessage is full chunk message ready to be sent
+type ChunkMessage struct {
+	Seq  uint32
+	Data []byte
+	Size uint32 // Length of original data chunk stands for
+}
+
 // DecodeHeader decodes slice of bytes to Header
 func DecodeHeader(message []byte) (*Header, error) {
 	if len(message) != 4 {
@@ -71,3 +82,8 @@ func DecodePayload(payload []byte, dst interface{}, encryption *Crypto) error {
 	err := binary.Read(buffer, binary.LittleEndian, dst)
 	return err
 }
+
+// ChunkChecksum returns checksum of chunk payload as sent
+func ChunkChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
@@ -6,4 +6,13 @@ const (
 	BEGINFILETRANSFER        // 2: Request file transfer
 	NEXTCHUNK                // 3: Next chunk of file data
 	ENDFILETRANSFER          // 4: EOF
+	DICTIONARY               // 5: Session compression dictionary
+	SIGNATURES               // 6: Block signatures of existing file
+	CHUNKQUERY               // 7: Which chunks server already has
+	NACK                     // 8: Chunk failed verification
+	TREE                     // 9: Hash tree of file on server
+	TREEQUERY                // 10: Nodes of hash tree
+	REPAIR                   // 11: Corrected block of file
+	LIST                     // 12: Files stored by server
+	CHECKSUM                 // 13: Checksum of file on server
 )
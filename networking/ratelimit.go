@@ -0,0 +1,130 @@
+package networking
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateWindow is time of day during which given rate applies
+type rateWindow struct {
+	from, to time.Duration // Time since midnight. Window wraps past midnight if to is before from.
+	rate     int64
+}
+
+// RateLimiter limits bandwidth with token bucket whose rate may depend on time of day
+type RateLimiter struct {
+	windows  []rateWindow
+	fallback int64 // Rate outside windows, zero for unlimited
+	tokens   float64
+	last     time.Time
+	lock     sync.Mutex
+	now      func() time.Time    // Clock, replaced in tests
+	sleep    func(time.Duration) // Waits on clock, replaced in tests
+}
+
+// NewRateLimiter parses comma separated list of rates in bytes per second with optional K, M or G suffix. Rate
+// may be preceded by time of day window such as 08:00-18:00= during which it applies. Rate without window applies
+// at other times. Zero or off means unlimited.
+func NewRateLimiter(spec string) (*RateLimiter, error) {
+	limiter := &RateLimiter{now: time.Now, sleep: time.Sleep}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		window, rate, found := strings.Cut(rule, "=")
+		if !found {
+			rate = window
+		}
+		value, err := parseRate(rate)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			limiter.fallback = value
+			continue
+		}
+
+		from, to, _ := strings.Cut(window, "-")
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, err
+		}
+		limiter.windows = append(limiter.windows, rateWindow{from: start, to: end, rate: value})
+	}
+	return limiter, nil
+}
+
+// parseRate parses rate in bytes per second with optional K, M or G suffix
+func parseRate(value string) (int64, error) {
+	if strings.EqualFold(value, "off") {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	if number != "" {
+		if unit := strings.IndexByte("KMG", number[len(number)-1]); unit >= 0 {
+			multiplier = int64(1) << (10 * (unit + 1))
+			number = number[:len(number)-1]
+		}
+	}
+	rate, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, errors.New("invalid rate: " + value)
+	}
+	return rate * multiplier, nil
+}
+
+// parseTimeOfDay parses time in HH:MM format as time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.New("invalid time of day: " + value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Rate returns rate in bytes per second at given time, zero if unlimited
+func (r *RateLimiter) Rate(now time.Time) int64 {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	since := now.Sub(midnight)
+	for _, window := range r.windows {
+		if window.from <= window.to && since >= window.from && since < window.to ||
+			window.from > window.to && (since >= window.from || since < window.to) {
+			return window.rate
+		}
+	}
+	return r.fallback
+}
+
+// Wait blocks until given number of bytes may be transferred. Bucket holds at most one second worth of tokens but
+// may go into debt for transfers larger than that. Does nothing if limiter is nil.
+func (r *RateLimiter) Wait(bytes int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	rate := float64(r.Rate(now))
+	if rate == 0 {
+		r.last = time.Time{}
+		return
+	}
+	if r.last.IsZero() {
+		r.tokens = rate
+	} else {
+		r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*rate, rate)
+	}
+	r.last = now
+
+	r.tokens -= float64(bytes)
+	if r.tokens < 0 {
+		r.sleep(time.Duration(-r.tokens / rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,103 @@
+package networking
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns given time of day
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestRateLimiterSchedule(t *testing.T) {
+	tests := []struct {
+		spec string
+		now  time.Time
+		want int64
+	}{
+		{"0", at(12, 0), 0},
+		{"off", at(12, 0), 0},
+		{"512", at(12, 0), 512},
+		{"10K", at(12, 0), 10 << 10},
+		{"10kb", at(12, 0), 10 << 10},
+		{"2M", at(12, 0), 2 << 20},
+		{"1G", at(12, 0), 1 << 30},
+		{"08:00-18:00=1M", at(12, 0), 1 << 20},
+		{"08:00-18:00=1M", at(18, 0), 0},
+		{"08:00-18:00=1M", at(7, 59), 0},
+		{"08:00-18:00=1M,10M", at(20, 0), 10 << 20},
+		{"08:00-18:00=1M,10M", at(8, 0), 1 << 20},
+		{"22:00-06:00=off,1M", at(23, 30), 0},
+		{"22:00-06:00=off,1M", at(3, 0), 0},
+		{"22:00-06:00=off,1M", at(6, 0), 1 << 20},
+		{"22:00-06:00=off,1M", at(21, 59), 1 << 20},
+		{"1M, 09:00-17:00=100K", at(10, 0), 100 << 10},
+	}
+	for _, test := range tests {
+		t.Run(test.spec+" "+test.now.Format("15:04"), func(t *testing.T) {
+			limiter, err := NewRateLimiter(test.spec)
+			if err != nil {
+				t.Fatalf("NewRateLimiter: %v", err)
+			}
+			if rate := limiter.Rate(test.now); rate != test.want {
+				t.Errorf("Rate = %d, want %d", rate, test.want)
+			}
+		})
+	}
+}
+
+func TestInvalidRateLimiter(t *testing.T) {
+	tests := []string{"", "fast", "-1", "1.5M", "10X", "08:00=1M", "8-18=1M", "08:00-25:00=1M", "08:00-18:00=lots"}
+	for _, spec := range tests {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := NewRateLimiter(spec); err == nil {
+				t.Errorf("invalid rate %q was accepted", spec)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		writes []int           // Bytes passed to Wait
+		gaps   []time.Duration // Time passing before each write
+		want   time.Duration   // Total time spent sleeping
+	}{
+		{"within burst", "1000", []int{500, 500}, []time.Duration{0, 0}, 0},
+		{"over burst", "1000", []int{1000, 500}, []time.Duration{0, 0}, 500 * time.Millisecond},
+		{"refilled", "1000", []int{1000, 1000}, []time.Duration{0, time.Second}, 0},
+		{"large write", "1000", []int{3000}, []time.Duration{0}, 2 * time.Second},
+		{"debt paid", "1000", []int{3000, 1000}, []time.Duration{0, 0}, 3 * time.Second},
+		{"unlimited", "0", []int{1 << 30, 1 << 30}, []time.Duration{0, 0}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter, err := NewRateLimiter(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock := at(12, 0)
+			var slept time.Duration
+			limiter.now = func() time.Time { return clock }
+			limiter.sleep = func(d time.Duration) {
+				slept += d
+				clock = clock.Add(d)
+			}
+
+			for i, bytes := range test.writes {
+				clock = clock.Add(test.gaps[i])
+				limiter.Wait(bytes)
+			}
+			if diff := slept - test.want; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("slept %v, want %v", slept, test.want)
+			}
+		})
+	}
+
+	// Nil limiter does not limit.
+	var limiter *RateLimiter
+	limiter.Wait(1 << 30)
+}
@@ -3,20 +3,25 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"go_fast_copy/constants"
 	"go_fast_copy/fileio"
+	"go_fast_copy/metrics"
 	"go_fast_copy/networking"
 	"go_fast_copy/networking/opcode"
 	"go_fast_copy/server/worker"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,13 +29,60 @@ type Handler struct {
 	writer      *worker.ChunkProcessor
 	crypto      *networking.Crypto
 	requireAuth bool
+	dictionary  []byte
+	target      string
+	temp        string
+	modTime     time.Time
+	store       *fileio.ChunkStore
+	cache       *fileio.ChecksumCache
+	cacheable   bool                    // Checksum of written file may be cached
+	written     string                  // File being written, temporary one if in use
+	tree        *fileio.MerkleTree      // Hash tree client may compare with
+	repair      *os.File                // File whose corrupted blocks client is sending again
+	output      io.Writer               // Received files are written here instead of under root path if set
+	archive     *fileio.Archive         // Received files are appended to archive instead if set
+	archived    *tar.Header             // Header of file being received into archive
+	restKey     []byte                  // Stored files are encrypted with this key if set
+	packed      bool                    // Stored files are kept compressed as chunks were received
+	limiter     *networking.RateLimiter // Limits bandwidth of file data received if set
+	sendLock    sync.Mutex              // Guards writes which may happen while workers send NACKs
+	log         *slog.Logger            // Logger of current session
+	started     time.Time               // When current file transfer started
+	audit       *fileio.AuditLog        // Every file transfer attempt is recorded here if set
+	auditing    *fileio.AuditRecord     // Record of file transfer in progress
+	session     string                  // ID of current session
+	remote      string                  // Address of client of current session
+	identity    string                  // Identity client authenticates as
+	formats     *fileio.FormatIndex     // Records how stored files are stored
+	format      string                  // Format file being received is stored in
+	size        int64                   // Size of original contents of file received
+	endToEnd    bool                    // File received is encrypted end-to-end so its size is the one client declared
+}
+
+// newHandler returns handler of client requests storing files under given folder
+func newHandler(folder string, options *ServerOptions) *Handler {
+	return &Handler{
+		cache:   fileio.NewChecksumCache(folder + constants.CacheFile),
+		formats: fileio.NewFormatIndex(folder),
+		output:  options.Output,
+		archive: options.Archive,
+		restKey: options.RestKey,
+		packed:  options.Packed,
+		limiter: options.Limiter,
+		audit:   options.Audit,
+		log:     slog.Default(),
+	}
 }
 
 // initCrypto initializes encryption with given key and nonce
 func (h *Handler) initCrypto(passphrase string, nonce []byte) {
 	h.requireAuth = !(passphrase == "")
+	h.identity = "anonymous"
 
 	if h.requireAuth {
+		// Key itself is never recorded, only its fingerprint.
+		fingerprint := sha256.Sum256([]byte(passphrase))
+		h.identity = "key:" + hex.EncodeToString(fingerprint[:8])
 		h.crypto = new(networking.Crypto).WithKeyNonce([]byte(passphrase), nonce)
 	} else {
 		h.crypto = new(networking.Crypto).WithKeyNonce(nil, nil)
@@ -71,12 +123,88 @@ func (h *Handler) handleHandshake(conn net.Conn, packet *networking.Packet) bool
 		resp.Flags = 0
 	}
 
+	if resp.Flags > 0 {
+		// Let client know which codecs it may use.
+		resp.Payload = networking.PayloadToBytes(&networking.Capabilities{
+			Codecs: 1<<constants.CODEC_NONE | 1<<constants.CODEC_LZ4 | 1<<constants.CODEC_LZ4_DICT,
+			Hashes: fileio.SupportedHashes(),
+		}, h.crypto)
+	}
+
 	out, _ := networking.PacketToBytes(&resp)
 	conn.Write(out)
 
 	return resp.Flags > 0
 }
 
+// handleDictionary handles response to compression dictionary announcement
+func (h *Handler) handleDictionary(conn net.Conn, packet *networking.Packet) {
+	resp := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.DICTIONARY,
+			Flags:  1,
+		},
+	}
+
+	var dict networking.DictionaryBlock
+	if networking.DecodePayload(packet.Payload, &dict, h.crypto) != nil ||
+		dict.BlockLen > constants.MAX_DICTIONARY_SIZE*1024 {
+		h.log.Warn("Malformed dictionary from client")
+		conn.Close()
+		return
+	}
+
+	block := make([]byte, dict.BlockLen)
+
+	// Read dictionary. Apply time constraints.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(conn, block)
+	if err != nil {
+		h.log.Warn("Incomplete dictionary from client", "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	block = h.crypto.Decrypt(block)
+
+	if crc32.ChecksumIEEE(block) != dict.Checksum {
+		h.log.Warn("Dictionary checksum mismatch. Rejecting dictionary.")
+		resp.Flags = 0
+	} else {
+		h.log.Info("Using compression dictionary from client", "size", len(block))
+		h.dictionary = block
+	}
+
+	out, _ := networking.PacketToBytes(&resp)
+	conn.Write(out)
+}
+
+// reserved returns true if name is one of server's own files in root folder
+func reserved(name string) bool {
+	switch name {
+	case constants.StoreDir, constants.CacheFile, constants.ArchiveIndex, constants.ArchivePart, constants.AuditLog,
+		constants.FormatIndex:
+		return true
+	}
+	return false
+}
+
+// localize returns local path of file with given name under root path
+func localize(name, rootPath string) (string, error) {
+	localizedPath, err := filepath.Localize(name)
+	// Neither localize nor To/FromSlash seem to convert paths between OS formats.
+	localizedPath = strings.ReplaceAll(localizedPath, "\\", string(os.PathSeparator))
+	localizedPath = strings.ReplaceAll(localizedPath, "/", string(os.PathSeparator))
+
+	if first := strings.SplitN(localizedPath, string(os.PathSeparator), 2)[0]; err == nil && reserved(first) {
+		// Chunk store, checksum cache, archive index, audit log and format index are off limits.
+		err = errors.New("reserved path")
+	}
+
+	return rootPath + localizedPath, err
+}
+
 // startFileTransfer handles response to file transfer request
 func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, rootPath string, blocksize, forks, wqlen int) {
 	if h.writer != nil {
@@ -102,11 +230,9 @@ func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, ro
 	header, err := tarra.Next()
 
 	if err == nil {
-		localizedPath, err := filepath.Localize(header.Name)
-		// Neither localize nor To/FromSlash seem to convert paths between OS formats.
-		localizedPath = strings.ReplaceAll(localizedPath, "\\", string(os.PathSeparator))
-		localizedPath = strings.ReplaceAll(localizedPath, "/", string(os.PathSeparator))
-		filename := rootPath + localizedPath
+		var sigs *fileio.Signatures
+
+		filename, err := localize(header.Name, rootPath)
 
 		resp := networking.Packet{
 			Header: networking.Header{
@@ -117,9 +243,33 @@ func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, ro
 
 		if err != nil {
 			resp.Flags = 3
-			fmt.Println("Invalid path requested:", filename)
+			h.log.Warn("Invalid path requested", "file", header.Name, "error", err)
+		} else if packet.Flags != constants.HASH_NONE && fileio.NewHash(packet.Flags) == nil {
+			resp.Flags = 3
+			h.log.Warn("Unsupported checksum algorithm requested", "file", header.Name, "algorithm", packet.Flags)
+		} else if h.archive != nil {
+			h.log.Info("Received client request to archive", "file", header.Name, "size", header.Size)
+
+			if header.PAXRecords[constants.PAXProbe] != "" {
+				// Every file is appended to archive.
+				out, _ := networking.PacketToBytes(&resp)
+				conn.Write(out)
+				return
+			}
+		} else if h.output != nil {
+			h.log.Info("Received client request to write to standard output", "file", header.Name, "size", header.Size)
+
+			if header.PAXRecords[constants.PAXProbe] != "" {
+				// Everything is accepted. Nothing to prepare.
+				out, _ := networking.PacketToBytes(&resp)
+				conn.Write(out)
+				return
+			}
 		} else {
-			fmt.Println("Received client request to start transfer for:", filename)
+			h.log.Info("Received client request to start transfer", "file", filename, "size", header.Size)
+
+			// Client only wants to know whether file would be transferred.
+			probe := header.PAXRecords[constants.PAXProbe] != ""
 
 			// Walk the path of light.
 			err = filepath.Walk(filepath.Dir(filename), func(path string, info fs.FileInfo, err error) error {
@@ -129,6 +279,9 @@ func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, ro
 				}
 				if err != nil {
 					if errors.Is(err, os.ErrNotExist) {
+						if probe {
+							return nil
+						}
 						// Create the directory if it doesn't already exist.
 						return os.MkdirAll(path, os.ModePerm)
 					} else {
@@ -138,26 +291,51 @@ func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, ro
 				return nil
 			})
 
+			if info, statErr := os.Stat(filename); err == nil && statErr == nil && info.IsDir() {
+				// Can't replace folder with file.
+				err = errors.New("invalid path " + filename + ": is a directory")
+			}
+
 			if err != nil {
 				resp.Flags = 3
-				fmt.Println(err.Error())
+				h.log.Warn("Could not prepare folder for file", "file", filename, "error", err)
 			} else {
-				// File checksum enabled.
-				if packet.Flags > 0 {
-					// File with same name already exists.
-					if _, err = os.Stat(filename); err == nil {
-						var hash []byte
-						if packet.Flags == 1 {
-							// Use CRC32 to check if file is identical.
-							hash = fileio.GetFileChecksumCRC32(filename)
-						} else if packet.Flags == 2 {
-							// Use SHA256 to check if file is identical.
-							hash = fileio.GetFileChecksumSHA256(filename)
-						}
-						// File with same name and content exists. No need to transfer it.
-						if header.PAXRecords[constants.PAXAttr] == hex.EncodeToString(hash) {
-							resp.Flags = 2
-						}
+				existing, statErr := os.Stat(filename)
+				_, compare := header.PAXRecords[constants.PAXAttr]
+				// Client asks to compare checksum of file with same name that already exists.
+				if packet.Flags > 0 && compare && statErr == nil {
+					// Use algorithm chosen by client to check if file is identical.
+					hash := h.checksum(filename, existing, packet.Flags)
+					// File with same name and content exists. No need to transfer it.
+					if hash != nil && header.PAXRecords[constants.PAXAttr] == hex.EncodeToString(hash) {
+						resp.Flags = 2
+					}
+				} else if statErr == nil && existing.Mode().IsRegular() && !header.ModTime.IsZero() &&
+					header.PAXRecords[constants.PAXSkip] != "" && header.PAXRecords[constants.PAXStream] == "" {
+					// Client asks to consider file with same name, size and modification time identical. Size of
+					// streamed file is only known once it ends.
+					if _, size := h.formats.Lookup(filename, existing); size == header.Size &&
+						existing.ModTime().Unix() == header.ModTime.Unix() {
+						resp.Flags = 2
+					}
+				}
+				if probe {
+					// Tell client whether file would be transferred without preparing to receive it.
+					out, _ := networking.PacketToBytes(&resp)
+					conn.Write(out)
+					return
+				}
+				// Client wants to only send chunks missing from chunk store.
+				if resp.Flags == 1 && h.store != nil && header.PAXRecords[constants.PAXDedup] != "" {
+					resp.Flags = 5
+				}
+				// Client would rather only send what differs from existing file. Encrypted and packed files can't
+				// be read or patched at arbitrary offsets.
+				if resp.Flags == 1 && statErr == nil && existing.Mode().IsRegular() && h.restKey == nil && !h.packed &&
+					header.PAXRecords[constants.PAXDelta] != "" && h.storedAsIs(filename, existing) {
+					sigs, err = fileio.FileSignatures(filename, fileio.DeltaBlockSize(existing.Size()))
+					if err == nil && len(sigs.Blocks) > 0 {
+						resp.Flags = 4
 					}
 				}
 			}
@@ -166,21 +344,100 @@ func (h *Handler) startFileTransfer(conn net.Conn, packet *networking.Packet, ro
 		out, _ := networking.PacketToBytes(&resp)
 		conn.Write(out)
 
+		record := &fileio.AuditRecord{
+			Time:     time.Now().UTC(),
+			Session:  h.session,
+			Remote:   h.remote,
+			Identity: h.identity,
+			Name:     header.Name,
+			Size:     header.Size,
+			Hash:     fileio.HashName(packet.Flags),
+		}
+		if h.output == nil {
+			record.Path = filename
+		}
+
 		if resp.Flags == 2 {
-			fmt.Println("Identical file already exists locally. Omitting transfer!")
+			h.log.Info("Identical file already exists locally. Omitting transfer.", "file", filename)
+			record.Result = fileio.AuditIdentical
+			record.Skipped = true
+			h.recordAudit(record)
 			return
 		} else if resp.Flags == 3 {
-			fmt.Println("Could not start transfer for requested file")
+			h.log.Warn("Could not start transfer for requested file", "file", filename)
+			record.Result = fileio.AuditRejected
+			h.recordAudit(record)
 			conn.Close()
 			return
 		}
+		h.auditing = record
+
+		h.resetRepair()
+		h.target = filename
+		h.temp = ""
+		h.modTime = header.ModTime
+		h.format = fileio.FormatPlain
+		h.size = header.Size
+		_, h.endToEnd = header.PAXRecords[constants.PAXSealed]
+
+		var factory fileio.IOFactory = &fileio.BufferedFactory{Key: h.restKey, Packed: h.packed}
+		if h.restKey != nil {
+			h.format = fileio.FormatSealed
+		} else if h.packed {
+			h.format = fileio.FormatPacked
+		}
+
+		if h.output != nil {
+			// Nothing is stored so there's no file to set modification time of.
+			factory = &fileio.StreamFactory{Target: h.output}
+			h.modTime = time.Time{}
+		} else if h.archive != nil {
+			// Receive into temporary file which is appended to archive once verified.
+			h.archived = archiveHeader(header, filename[len(rootPath):])
+			h.modTime = time.Time{}
+			filename = rootPath + constants.ArchivePart
+		} else if resp.Flags == 4 {
+			h.log.Info("Existing file differs. Sending block signatures for delta transfer", "file", filename,
+				"blocks", len(sigs.Blocks))
+			h.sendSignatures(conn, sigs)
+		} else if resp.Flags == 5 {
+			h.log.Info("Storing file deduplicated in chunk store", "file", filename)
+			factory = new(fileio.ManifestFactory)
+			h.format = fileio.FormatManifest
+		}
+
+		if resp.Flags == 4 || resp.Flags == 5 {
+			// Write into temporary file so existing one stays intact until verified.
+			h.temp = filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".gfcpart")
+			filename = h.temp
+		}
+
+		h.written = filename
+		h.started = time.Now()
+		// Checksum of manifest is not checksum of file contents.
+		h.cacheable = resp.Flags != 5 && h.output == nil && h.archive == nil
 
 		// Start writer and workers.
 		h.writer = new(worker.ChunkProcessor)
-		h.writer.NewFile(new(fileio.BufferedFactory), filename, blocksize, wqlen, packet.Flags == 2)
-		h.writer.StartForks(forks, h.crypto)
+		h.writer.NewFile(factory, filename, blocksize, wqlen, packet.Flags)
+		h.writer.UseLogger(h.log.With("file", h.target))
+		if resp.Flags != 5 && h.output == nil && h.restKey == nil && !h.packed && header.PAXRecords[constants.PAXTree] != "" {
+			// Client wants to be able to repair file by only sending corrupted blocks again.
+			h.writer.UseTree(constants.MERKLE_BLOCK_SIZE * 1024)
+		}
+		if resp.Flags == 4 {
+			h.writer.UseBasis(h.target)
+		} else if resp.Flags == 5 {
+			h.writer.UseStore(h.store)
+		} else if h.packed {
+			h.writer.UsePacking()
+		}
+		h.writer.UseNack(func(seq uint32) {
+			h.sendNack(conn, seq)
+		})
+		h.writer.StartForks(forks, h.crypto, h.dictionary)
 	} else {
-		fmt.Println(err)
+		h.log.Warn("Malformed file transfer request", "error", err)
 		conn.Close()
 	}
 }
@@ -190,12 +447,60 @@ func (h *Handler) endFileTransfer(conn net.Conn, packet *networking.Packet) {
 	var end networking.EndFileTransfer
 	err := networking.DecodePayload(packet.Payload, &end, h.crypto)
 
-	// Wait for file writer to complete.
-	hash := h.writer.Stop()
+	if h.writer == nil && h.repair == nil {
+		conn.Close()
+		h.log.Warn("Client ended file transfer which was never started")
+		return
+	}
+
+	if err == nil && h.writer != nil {
+		pending, failure := h.writer.Drain()
+		if failure != nil {
+			conn.Close()
+			h.abortTransfer()
+			h.log.Warn("Invalid chunk from client. Ending file transfer.", "file", h.target, "error", failure)
+			return
+		}
+		if pending > 0 {
+			// Client has been asked to send chunks again. It asks again to end transfer after sending them.
+			h.log.Warn("Chunks failed verification. Waiting for client to send them again", "file", h.target,
+				"chunks", pending)
+			resp := networking.Packet{
+				Header: networking.Header{
+					Opcode: packet.Opcode,
+					Flags:  2,
+				},
+			}
+			out, _ := networking.PacketToBytes(&resp)
+			h.sendLock.Lock()
+			conn.Write(out)
+			h.sendLock.Unlock()
+			return
+		}
+	}
+
+	var hash []byte
+	var tree *fileio.MerkleTree
+
+	if h.writer != nil {
+		// Wait for file writer to complete.
+		hash = h.writer.Stop()
+		tree = h.writer.Tree()
+		if !h.endToEnd {
+			h.size = h.writer.Size()
+		}
+		h.writer = nil
+		metrics.WriteQueue.Set(0)
+	} else {
+		// Corrupted blocks have been replaced. Check the whole file again.
+		h.resetRepair()
+		hash = fileio.GetFileChecksum(h.written, packet.Flags)
+	}
 
 	if err != nil {
 		conn.Close()
-		fmt.Println("Malformed teardown message from client. Ending file transfer without checksum.")
+		h.log.Warn("Malformed teardown message from client. Ending file transfer without checksum.", "file", h.target)
+		h.auditTransfer(fileio.AuditFailed, nil)
 		return
 	}
 
@@ -209,34 +514,457 @@ func (h *Handler) endFileTransfer(conn net.Conn, packet *networking.Packet) {
 		Checksum: [32]byte{},
 	}
 	copy(eft.Checksum[:], hash)
+	if tree != nil {
+		eft.Root = tree.Root()
+		eft.Size = tree.Size()
+	}
 	resp.Payload = networking.PayloadToBytes(eft, h.crypto)
+	result := fileio.AuditCompleted
 
 	if packet.Flags > 0 {
 		if end.Checksum != eft.Checksum {
-			fmt.Println("Checksum mismatch!")
+			if tree != nil && end.Root != [32]byte{} && end.Root != tree.Root() && end.Size == tree.Size() {
+				// Client finds corrupted blocks by comparing hash trees and sends only those again.
+				if h.repair, err = os.OpenFile(h.written, os.O_WRONLY, 0); err == nil {
+					h.log.Warn("Checksum mismatch. Waiting for client to send corrupted blocks again", "file", h.target)
+					metrics.ChecksumMismatches.Inc()
+					h.tree = tree
+					resp.Flags = 3
+					out, _ := networking.PacketToBytes(&resp)
+					h.sendLock.Lock()
+					conn.Write(out)
+					h.sendLock.Unlock()
+					return
+				}
+			}
+			h.log.Error("Checksum mismatch", "file", h.target, "hash", fileio.HashName(packet.Flags),
+				"expected", hex.EncodeToString(end.Checksum[:len(hash)]), "checksum", hex.EncodeToString(hash))
+			metrics.ChecksumMismatches.Inc()
+			result = fileio.AuditMismatch
 			resp.Flags = 0
 		} else {
-			fmt.Println("Checksum match. File transfer completed!")
+			h.log.Info("Checksum match. File transfer completed.", "file", h.target, "hash", fileio.HashName(packet.Flags),
+				"checksum", hex.EncodeToString(hash), "duration_ms", time.Since(h.started).Milliseconds())
 		}
 	} else {
-		fmt.Println("No checksum verification requested. File transfer completed!")
+		h.log.Info("No checksum verification requested. File transfer completed.", "file", h.target,
+			"duration_ms", time.Since(h.started).Milliseconds())
+	}
+
+	if h.temp != "" {
+		if resp.Flags == 1 {
+			// Replace existing file with reconstructed one.
+			if err := os.Rename(h.temp, h.target); err != nil {
+				h.log.Error("Could not replace existing file", "file", h.target, "error", err)
+				result = fileio.AuditFailed
+				resp.Flags = 0
+			}
+		} else {
+			// Keep existing file as it was.
+			os.Remove(h.temp)
+		}
+		h.temp = ""
+	}
+
+	if h.archive != nil {
+		if resp.Flags == 1 {
+			if packet.Flags > 0 {
+				h.archived.PAXRecords[constants.PAXAttr] = hex.EncodeToString(hash)
+				h.archived.PAXRecords[constants.PAXHash] = fileio.HashName(packet.Flags)
+			}
+			if entry, err := h.archive.Append(h.archived, h.written, h.format); err != nil {
+				h.log.Error("Could not append file to archive", "file", h.archived.Name, "error", err)
+				result = fileio.AuditFailed
+				resp.Flags = 0
+			} else {
+				h.log.Info("Appended file to archive", "file", entry.Name, "archive", entry.Archive, "offset", entry.Offset)
+			}
+		}
+		os.Remove(h.written)
+	}
+
+	if resp.Flags == 1 && !h.modTime.IsZero() {
+		// Keep modification time of the original so file is recognized as identical next time.
+		os.Chtimes(h.target, h.modTime, h.modTime)
 	}
 
+	if resp.Flags == 1 && h.output == nil && h.archive == nil {
+		// Remember how file is stored so it is never guessed from its contents.
+		if err := h.formats.Record(h.target, h.format, h.size); err != nil {
+			h.log.Error("Could not record format of stored file", "file", h.target, "error", err)
+		}
+	}
+
+	if resp.Flags == 1 && packet.Flags > 0 && h.cacheable {
+		// Remember verified checksum so identical file check need not calculate it again.
+		h.cache.Put(h.target, packet.Flags, hash)
+	}
+
+	if resp.Flags == 1 {
+		metrics.FilesCompleted.Inc()
+		if h.auditing != nil {
+			// Size of streamed file is only known once it ends.
+			h.auditing.Size = h.size
+		}
+	}
+	h.auditTransfer(result, hash)
+
 	out, _ := networking.PacketToBytes(&resp)
 
+	h.sendLock.Lock()
 	conn.Write(out)
-	h.writer = nil
+	h.sendLock.Unlock()
+}
+
+// abortTransfer stops writing file client did not finish sending and removes temporary file it was written to.
+// Existing file stays as it was.
+func (h *Handler) abortTransfer() {
+	if h.writer != nil {
+		h.writer.Stop()
+		h.writer = nil
+		metrics.WriteQueue.Set(0)
+	}
+	if h.temp != "" {
+		os.Remove(h.temp)
+		h.temp = ""
+	}
+}
+
+// auditTransfer records file transfer in progress in audit log with given result and checksum of received file.
+// Does nothing if no transfer is in progress.
+func (h *Handler) auditTransfer(result string, hash []byte) {
+	if h.auditing == nil {
+		return
+	}
+	record := h.auditing
+	h.auditing = nil
+	record.Result = result
+	record.Checksum = hex.EncodeToString(hash)
+	record.Duration = time.Since(h.started).Milliseconds()
+	h.recordAudit(record)
+}
+
+// recordAudit appends record to audit log if one is in use
+func (h *Handler) recordAudit(record *fileio.AuditRecord) {
+	if err := h.audit.Record(record); err != nil {
+		h.log.Error("Could not write audit log", "file", record.Name, "error", err)
+	}
+}
+
+// openStored opens stored file for reading its original contents
+func (h *Handler) openStored(filename string) (io.ReadCloser, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	format, _ := h.formats.Lookup(filename, info)
+	return fileio.OpenStored(filename, format, h.store, h.restKey)
+}
+
+// storedSize returns size of original contents of stored file
+func (h *Handler) storedSize(filename string, info os.FileInfo) int64 {
+	_, size := h.formats.Lookup(filename, info)
+	return size
+}
+
+// storedAsIs returns true if stored file holds its original contents
+func (h *Handler) storedAsIs(filename string, info os.FileInfo) bool {
+	format, _ := h.formats.Lookup(filename, info)
+	return format == fileio.FormatPlain
+}
+
+// checksum returns checksum of original contents of stored file. Cached checksum is used if file has not changed.
+func (h *Handler) checksum(filename string, info os.FileInfo, algorithm uint8) []byte {
+	hash := h.cache.Get(filename, info, algorithm)
+	if hash == nil {
+		format, _ := h.formats.Lookup(filename, info)
+		if stored, err := fileio.OpenStored(filename, format, h.store, h.restKey); err == nil {
+			hash = fileio.GetChecksum(stored, algorithm)
+			stored.Close()
+			h.cache.Put(filename, algorithm, hash)
+		}
+	}
+	return hash
+}
+
+// handleList sends names, sizes and modification times of all files stored under root path
+func (h *Handler) handleList(conn net.Conn, rootPath string) {
+	send := func(flags uint8, header *tar.Header) {
+		msg := networking.Packet{
+			Header: networking.Header{
+				Opcode: opcode.LIST,
+				Flags:  flags, // 0: last message, 1: more to follow
+			},
+		}
+		if header != nil {
+			buffer := new(bytes.Buffer)
+			tarra := tar.NewWriter(buffer)
+			tarra.WriteHeader(header)
+			tarra.Flush()
+			msg.Payload = h.crypto.Encrypt(buffer.Bytes())
+		}
+		out, _ := networking.PacketToBytes(&msg)
+		conn.Write(out)
+	}
+
+	filepath.WalkDir(rootPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == filepath.Clean(rootPath) {
+			return nil
+		}
+		name := entry.Name()
+		if reserved(name) || strings.HasSuffix(name, ".gfcpart") {
+			// Server's own files are not part of what it stores.
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		send(1, &tar.Header{
+			Format:   tar.FormatPAX,
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(path[len(rootPath):]),
+			Size:     h.storedSize(path, info),
+			ModTime:  info.ModTime(),
+		})
+		return nil
+	})
+
+	send(0, nil)
+}
+
+// handleChecksum responds with checksum of file client asks for
+func (h *Handler) handleChecksum(conn net.Conn, packet *networking.Packet, rootPath string) {
+	resp := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.CHECKSUM,
+			Flags:  0, // 0: file not available, 1: checksum follows
+		},
+	}
+
+	header, err := tar.NewReader(bytes.NewBuffer(h.crypto.Decrypt(packet.Payload))).Next()
+	if err == nil && fileio.NewHash(packet.Flags) != nil {
+		filename, err := localize(header.Name, rootPath)
+		if err == nil && strings.HasPrefix(filepath.Clean(filename), filepath.Clean(rootPath)) {
+			if info, err := os.Stat(filename); err == nil && info.Mode().IsRegular() {
+				if hash := h.checksum(filename, info, packet.Flags); hash != nil {
+					resp.Flags = 1
+					resp.Payload = h.crypto.Encrypt(hash)
+				}
+			}
+		}
+	}
+
+	out, _ := networking.PacketToBytes(&resp)
+	conn.Write(out)
+}
+
+// resetRepair forgets hash tree and closes file being repaired
+func (h *Handler) resetRepair() {
+	if h.repair != nil {
+		h.repair.Close()
+		h.repair = nil
+	}
+	h.tree = nil
+}
+
+// handleTreeRequest builds hash tree of file client wants to verify and responds with its root
+func (h *Handler) handleTreeRequest(conn net.Conn, packet *networking.Packet, rootPath string) {
+	resp := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.TREE,
+			Flags:  0, // 0: file not available, 1: tree follows
+		},
+	}
+
+	h.resetRepair()
+
+	header, err := tar.NewReader(bytes.NewBuffer(h.crypto.Decrypt(packet.Payload))).Next()
+	if err == nil {
+		filename, err := localize(header.Name, rootPath)
+		if err == nil && strings.HasPrefix(filepath.Clean(filename), filepath.Clean(rootPath)) {
+			h.log.Info("Received client request to verify", "file", filename)
+			if stored, err := h.openStored(filename); err == nil {
+				tree, err := fileio.BuildMerkleTree(stored, constants.MERKLE_BLOCK_SIZE*1024)
+				stored.Close()
+				if err == nil {
+					h.tree = tree
+					resp.Flags = 1
+					resp.Payload = networking.PayloadToBytes(&networking.TreeInfo{
+						Root: tree.Root(),
+						Size: tree.Size(),
+					}, h.crypto)
+				}
+			}
+		}
+	}
+
+	out, _ := networking.PacketToBytes(&resp)
+	conn.Write(out)
+}
+
+// handleTreeQuery responds with hashes of requested nodes of current hash tree
+func (h *Handler) handleTreeQuery(conn net.Conn, packet *networking.Packet) {
+	payload := h.crypto.Decrypt(packet.Payload)
+	headerLen := binary.Size(networking.TreeQuery{})
+
+	var query networking.TreeQuery
+	if len(payload) < headerLen || networking.DecodePayload(payload[:headerLen], &query, nil) != nil {
+		h.log.Warn("Malformed tree query from client")
+		conn.Close()
+		return
+	}
+	indexes := make([]uint32, query.Count)
+	if networking.DecodePayload(payload[headerLen:], indexes, nil) != nil {
+		h.log.Warn("Malformed tree query from client")
+		conn.Close()
+		return
+	}
+
+	hashes := make([][32]byte, len(indexes))
+	if h.tree != nil {
+		for i, index := range indexes {
+			hashes[i], _ = h.tree.Node(int(query.Level), index)
+		}
+	}
+
+	resp := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.TREEQUERY,
+			Flags:  1,
+		},
+		Payload: networking.PayloadToBytes(hashes, h.crypto),
+	}
+	out, _ := networking.PacketToBytes(&resp)
+	conn.Write(out)
+}
+
+// handleRepair replaces corrupted block of file with one sent by client
+func (h *Handler) handleRepair(conn net.Conn, packet *networking.Packet) {
+	var repair networking.BlockRepair
+	if networking.DecodePayload(packet.Payload, &repair, h.crypto) != nil || h.repair == nil ||
+		repair.Length > constants.MERKLE_BLOCK_SIZE*1024 {
+		h.log.Warn("Malformed block repair from client")
+		conn.Close()
+		return
+	}
+
+	data := make([]byte, repair.Length)
+	h.limiter.Wait(len(data))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		h.log.Warn("Incomplete block from client", "error", err)
+		conn.Close()
+		return
+	}
+
+	if _, err := h.repair.WriteAt(h.crypto.Decrypt(data), int64(repair.Offset)); err != nil {
+		h.log.Error("Could not repair block", "file", h.written, "offset", repair.Offset, "error", err)
+		conn.Close()
+	}
+}
+
+// sendNack asks client to send chunk which failed verification again
+func (h *Handler) sendNack(conn net.Conn, seq uint32) {
+	h.log.Debug("Chunk failed verification. Asking client to send it again", "file", h.target, "chunk", seq)
+	msg := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.NACK,
+		},
+	}
+	msg.Payload = networking.PayloadToBytes(&networking.ChunkNack{Sequence: seq}, h.crypto)
+	out, _ := networking.PacketToBytes(&msg)
+	h.sendLock.Lock()
+	conn.Write(out)
+	h.sendLock.Unlock()
+}
+
+// handleChunkQuery responds with bitmap of which queried chunks are already in chunk store
+func (h *Handler) handleChunkQuery(conn net.Conn, packet *networking.Packet) {
+	payload := h.crypto.Decrypt(packet.Payload)
+	headerLen := binary.Size(networking.ChunkQuery{})
+
+	var query networking.ChunkQuery
+	if len(payload) < headerLen || networking.DecodePayload(payload[:headerLen], &query, nil) != nil {
+		h.log.Warn("Malformed chunk query from client")
+		conn.Close()
+		return
+	}
+	hashes := make([][32]byte, query.Count)
+	if networking.DecodePayload(payload[headerLen:], hashes, nil) != nil {
+		h.log.Warn("Malformed chunk query from client")
+		conn.Close()
+		return
+	}
+
+	bitmap := make([]byte, (len(hashes)+7)/8)
+	if h.store != nil {
+		for i, hash := range hashes {
+			if h.store.Has(hash) {
+				bitmap[i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+
+	resp := networking.Packet{
+		Header: networking.Header{
+			Opcode: opcode.CHUNKQUERY,
+			Flags:  1,
+		},
+		Payload: h.crypto.Encrypt(bitmap),
+	}
+	out, _ := networking.PacketToBytes(&resp)
+	conn.Write(out)
+}
+
+// sendSignatures sends block signatures of existing file in as many messages as needed
+func (h *Handler) sendSignatures(conn net.Conn, sigs *fileio.Signatures) {
+	for sent := 0; sent < len(sigs.Blocks); {
+		count := min(len(sigs.Blocks)-sent, constants.SIGNATURES_PER_MESSAGE)
+
+		msg := networking.Packet{
+			Header: networking.Header{
+				Opcode: opcode.SIGNATURES,
+				Flags:  0, // 0: last message, 1: more to follow
+			},
+		}
+		if sent+count < len(sigs.Blocks) {
+			msg.Flags = 1
+		}
+
+		payload := networking.PayloadToBytes(&networking.SignatureBlock{
+			BlockSize: uint32(sigs.BlockSize),
+			Count:     uint16(count),
+		}, nil)
+		payload = append(payload, networking.PayloadToBytes(sigs.Blocks[sent:sent+count], nil)...)
+		msg.Payload = h.crypto.Encrypt(payload)
+
+		out, _ := networking.PacketToBytes(&msg)
+		conn.Write(out)
+
+		sent += count
+	}
 }
 
 // nextFileDataChunk handles processing of data chunks
 func (h *Handler) nextFileDataChunk(conn net.Conn, packet *networking.Packet) {
-	var chonk networking.DataStreamChunk
-	err := networking.DecodePayload(packet.Payload, &chonk, h.crypto)
+	// Only verified chunks carry checksum, so header of other chunks stays as it always was.
+	var chonk networking.VerifiedStreamChunk
+	var header interface{} = &chonk.DataStreamChunk
+	if packet.Flags&constants.CHUNK_VERIFIED != 0 {
+		header = &chonk
+	}
+	err := networking.DecodePayload(packet.Payload, header, h.crypto)
 
 	if err != nil {
 		conn.Close()
-		h.writer.Stop()
-		fmt.Println("Malformed chunk message from client. Ending file transfer.")
+		h.abortTransfer()
+		h.log.Warn("Malformed chunk message from client. Ending file transfer.", "file", h.target)
 		return
 	}
 
@@ -246,20 +974,58 @@ func (h *Handler) nextFileDataChunk(conn net.Conn, packet *networking.Packet) {
 
 	chunkData := make([]byte, chonk.DataLength)
 
+	// Leave chunk waiting in socket until bandwidth allows receiving it.
+	h.limiter.Wait(len(chunkData))
+
 	// Read full chunk.
 	_, err = io.ReadFull(conn, chunkData)
 
 	if err != nil {
 		conn.Close()
-		h.writer.Stop()
-		fmt.Println("Incomplete chunk from client. Ending file transfer.")
+		h.abortTransfer()
+		h.log.Warn("Incomplete chunk from client. Ending file transfer.", "file", h.target, "error", err)
 		return
 	}
 
+	metrics.ReceivedCompressed.Add(uint64(len(chunkData)))
+	metrics.WriteQueue.Set(int64(h.writer.Queued()))
+
 	// Have workers process the chunk.
-	h.writer.ProcessNextChunk(&worker.UnprocessedChunk{
-		Seq:        chonk.Sequence,
-		Compressed: chonk.Compression > 0,
-		Data:       chunkData,
+	err = h.writer.ProcessNextChunk(&worker.UnprocessedChunk{
+		Seq:      chonk.Sequence,
+		Kind:     packet.Flags &^ constants.CHUNK_VERIFIED,
+		Codec:    chonk.Compression,
+		Data:     chunkData,
+		Verify:   packet.Flags&constants.CHUNK_VERIFIED != 0,
+		Checksum: chonk.Checksum,
 	})
+
+	if err != nil {
+		conn.Close()
+		h.abortTransfer()
+		h.log.Warn("Invalid chunk from client. Ending file transfer.", "file", h.target, "error", err)
+	}
+}
+
+// archiveHeader returns header under which file is appended to archive. Client's own PAX records are kept
+// apart from ones which only control the transfer.
+func archiveHeader(header *tar.Header, name string) *tar.Header {
+	records := make(map[string]string)
+	for key, value := range header.PAXRecords {
+		switch key {
+		case constants.PAXDelta, constants.PAXDedup, constants.PAXTree, constants.PAXProbe, constants.PAXStream,
+			constants.PAXAttr:
+			// Checksum is only recorded once verified.
+		default:
+			records[key] = value
+		}
+	}
+	return &tar.Header{
+		Format:     tar.FormatPAX,
+		Typeflag:   tar.TypeReg,
+		Name:       filepath.ToSlash(name),
+		Mode:       0644,
+		ModTime:    header.ModTime,
+		PAXRecords: records,
+	}
 }
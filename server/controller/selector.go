@@ -2,14 +2,18 @@ package server
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"go_fast_copy/metrics"
 	"go_fast_copy/networking"
 	"go_fast_copy/networking/opcode"
+	"go_fast_copy/server/logging"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"math/rand"
@@ -24,23 +28,48 @@ type Server struct {
 	handler       *Handler
 }
 
-// StartListening binds new listening socket
-func (s *Server) StartListening(key, path, addr string, blocksize, numworkers, queue int, mptcp bool) {
+// ServerOptions holds optional settings of how server stores received files
+type ServerOptions struct {
+	Dedup   bool                    // Files are stored deduplicated in chunk store under root folder
+	Output  io.Writer               // Received files are written here instead of root folder if set
+	Archive *fileio.Archive         // Received files are appended to archive instead if set
+	RestKey []byte                  // Stored files are encrypted with this key if set
+	Packed  bool                    // Files are stored compressed as chunks are received
+	Limiter *networking.RateLimiter // File data is received no faster than limiter allows if set
+	Audit   *fileio.AuditLog        // Every file transfer attempt is recorded here if set
+}
+
+// StartListening binds new listening socket. If output is given in options, server stops once first client
+// disconnects. Records are written to default logger.
+func (s *Server) StartListening(key, path, addr string, blocksize, numworkers, queue int, mptcp bool,
+	options *ServerOptions) {
 	var err error
 	s.chunksize = blocksize * 1024
 	s.workers = numworkers
 	s.wqlen = queue
 	s.folder = filepath.Clean(path) + string(os.PathSeparator)
-	s.handler = new(Handler)
+	s.handler = newHandler(s.folder, options)
 
 	// Check path validity.
 	info, err := os.Stat(s.folder)
 
-	if err != nil || !info.IsDir() {
-		fmt.Println("Invalid root folder -", err.Error())
+	if options.Output == nil && (err != nil || !info.IsDir()) {
+		if err == nil {
+			err = errors.New("not a directory")
+		}
+		slog.Error("Invalid root folder", "path", s.folder, "error", err)
 		os.Exit(1)
 	}
 
+	if options.Dedup {
+		// Keep chunk store under root folder.
+		s.handler.store, err = fileio.NewChunkStore(s.folder + constants.StoreDir)
+		if err != nil {
+			slog.Error("Could not open chunk store", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	_, err = net.ResolveTCPAddr("tcp4", addr)
 
 	if err != nil {
@@ -54,27 +83,35 @@ func (s *Server) StartListening(key, path, addr string, blocksize, numworkers, q
 	l, err := lc.Listen(context.Background(), "tcp", addr)
 
 	if err != nil {
-		fmt.Println("Could not bind listening socket on " + addr)
+		slog.Error("Could not bind listening socket", "address", addr, "error", err)
 		os.Exit(1)
 	}
 
 	// Close the listener when the application closes.
 	defer l.Close()
 
-	fmt.Println("Listening on " + addr)
+	slog.Info("Listening", "address", addr)
 
 	for {
 		// Handle incoming connection.
 		conn, err := l.Accept()
-		// Set TCP_NODELAY to always immediately send.
-		conn.(*net.TCPConn).SetNoDelay(true)
 
 		if err != nil {
-			fmt.Println("Failed to establish incoming connection")
+			slog.Warn("Failed to establish incoming connection", "error", err)
 			continue
 		}
 
-		fmt.Println("New connection from: " + conn.RemoteAddr().String())
+		// Set TCP_NODELAY to always immediately send.
+		conn.(*net.TCPConn).SetNoDelay(true)
+
+		// Every record of session tells which client and session it belongs to.
+		s.handler.session = logging.NewSessionID()
+		s.handler.remote = conn.RemoteAddr().String()
+		s.handler.log = slog.With("session", s.handler.session, "remote", s.handler.remote)
+		s.handler.log.Info("New connection")
+		start := time.Now()
+		metrics.Sessions.Inc()
+		metrics.SessionsActive.Add(1)
 
 		s.authenticated = false
 		// Generate new nonce for session.
@@ -87,10 +124,25 @@ func (s *Server) StartListening(key, path, addr string, blocksize, numworkers, q
 		s.handleRequest(conn)
 		// Reset crypto.
 		s.handler.initCrypto("", nil)
+		// Forget session dictionary.
+		s.handler.dictionary = nil
+		// Abandon any unfinished repair.
+		s.handler.resetRepair()
+		// Stop writing any file client did not finish sending.
+		s.handler.abortTransfer()
+		// Record any transfer client did not finish.
+		s.handler.auditTransfer(fileio.AuditAborted, nil)
 		// Reset authentication state.
 		s.authenticated = false
 
-		fmt.Println("Client disconnected")
+		metrics.SessionsActive.Add(-1)
+		s.handler.log.Info("Client disconnected", "duration_ms", time.Since(start).Milliseconds())
+		s.handler.log = slog.Default()
+
+		if options.Output != nil {
+			// Whoever reads the output gets one session worth of files.
+			return
+		}
 	}
 }
 
@@ -142,7 +194,7 @@ func (s *Server) handleRequest(conn net.Conn) {
 			header, err := networking.DecodeHeader(msg)
 
 			if err != nil {
-				fmt.Println(conn.RemoteAddr().String() + " " + err.Error())
+				s.handler.log.Warn("Malformed header", "error", err)
 			} else {
 				packet := &networking.Packet{Header: *header}
 				var payload []byte
@@ -155,8 +207,7 @@ func (s *Server) handleRequest(conn net.Conn) {
 					len, err := io.ReadFull(conn, payload)
 
 					if len != int(payloadLen) || err != nil {
-						fmt.Println("Recv len mismatch: " + strconv.Itoa(len) +
-							" vs " + strconv.Itoa(int(payloadLen)) + " expected")
+						s.handler.log.Warn("Payload length mismatch", "received", len, "expected", payloadLen)
 						return
 					} else {
 						packet.Payload = payload
@@ -172,7 +223,7 @@ func (s *Server) handleRequest(conn net.Conn) {
 				}
 			}
 		} else {
-			fmt.Println(conn.RemoteAddr().String() + " sent malformed header")
+			s.handler.log.Warn("Malformed header")
 		}
 	}
 }
@@ -182,11 +233,16 @@ func (s *Server) dispatcher(conn net.Conn, packet *networking.Packet) {
 	if packet.Opcode == opcode.HANDSHAKE {
 		s.authenticated = s.handler.handleHandshake(conn, packet)
 		if !s.authenticated {
-			fmt.Println("Authentication failed for client", conn.RemoteAddr().String())
+			s.handler.log.Warn("Authentication failed")
+			metrics.AuthFailures.Inc()
 		}
 	} else {
 		// For messages other than authentication itself the connection must be authenticated.
-		if s.authenticated {
+		if s.authenticated && (s.handler.output != nil || s.handler.archive != nil) && !streamable(packet.Opcode) {
+			s.handler.log.Warn("Can't access stored files when writing to standard output or archive. Dropping connection",
+				"opcode", packet.Opcode)
+			conn.Close()
+		} else if s.authenticated {
 			switch packet.Opcode {
 			case opcode.BEGINFILETRANSFER:
 				s.handler.startFileTransfer(conn, packet, s.folder, s.chunksize, s.workers, s.wqlen)
@@ -194,13 +250,36 @@ func (s *Server) dispatcher(conn net.Conn, packet *networking.Packet) {
 				s.handler.nextFileDataChunk(conn, packet)
 			case opcode.ENDFILETRANSFER:
 				s.handler.endFileTransfer(conn, packet)
+			case opcode.DICTIONARY:
+				s.handler.handleDictionary(conn, packet)
+			case opcode.CHUNKQUERY:
+				s.handler.handleChunkQuery(conn, packet)
+			case opcode.TREE:
+				s.handler.handleTreeRequest(conn, packet, s.folder)
+			case opcode.TREEQUERY:
+				s.handler.handleTreeQuery(conn, packet)
+			case opcode.REPAIR:
+				s.handler.handleRepair(conn, packet)
+			case opcode.LIST:
+				s.handler.handleList(conn, s.folder)
+			case opcode.CHECKSUM:
+				s.handler.handleChecksum(conn, packet, s.folder)
 			default:
-				fmt.Println("Don't know what to do with message opcode " + strconv.Itoa(int(packet.Opcode)))
+				s.handler.log.Warn("Don't know what to do with message", "opcode", packet.Opcode)
 			}
 		} else {
-			fmt.Println("Dropping unauthorized connection", conn.RemoteAddr().String())
+			s.handler.log.Warn("Dropping unauthorized connection")
 			// Not authorized to perform any operations.
 			conn.Close()
 		}
 	}
 }
+
+// streamable returns true if message with given opcode can be handled without access to stored files
+func streamable(code uint8) bool {
+	switch code {
+	case opcode.BEGINFILETRANSFER, opcode.NEXTCHUNK, opcode.ENDFILETRANSFER, opcode.DICTIONARY:
+		return true
+	}
+	return false
+}
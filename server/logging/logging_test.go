@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		records  int
+		want     []int // Number of records in log file followed by each rotated file, newest first
+	}{
+		{"no rotation", 0, 3, 20, []int{20}},
+		{"under size", 1000, 3, 5, []int{5}},
+		{"rotated once", 100, 3, 15, []int{5, 10}},
+		{"all kept", 100, 3, 40, []int{10, 10, 10, 10}},
+		{"oldest dropped", 100, 2, 55, []int{5, 10, 10}},
+		{"nothing kept", 100, 0, 25, []int{5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "server.log")
+			file, err := OpenRotating(path, test.maxSize, test.maxFiles)
+			if err != nil {
+				t.Fatalf("OpenRotating: %v", err)
+			}
+			// Records are 10 bytes so ten fit in 100 byte file.
+			for i := 0; i < test.records; i++ {
+				fmt.Fprintf(file, "record %02d\n", i)
+			}
+			file.Close()
+
+			names := []string{path}
+			for i := 1; i < len(test.want); i++ {
+				names = append(names, path+"."+strconv.Itoa(i))
+			}
+			last := test.records
+			for i, name := range names {
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatalf("reading %s: %v", filepath.Base(name), err)
+				}
+				lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+				if len(lines) != test.want[i] {
+					t.Errorf("%s holds %d records, want %d", filepath.Base(name), len(lines), test.want[i])
+				}
+				// Newest records are in log file and older ones in files with higher number.
+				if want := fmt.Sprintf("record %02d", last-1); lines[len(lines)-1] != want {
+					t.Errorf("%s ends with %q, want %q", filepath.Base(name), lines[len(lines)-1], want)
+				}
+				last -= len(lines)
+			}
+			if _, err := os.Stat(path + "." + strconv.Itoa(len(test.want))); err == nil {
+				t.Errorf("more than %d rotated files kept", len(test.want)-1)
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	os.WriteFile(path, []byte("earlier run\n"), 0644)
+
+	// Size of existing file counts towards rotation.
+	file, err := OpenRotating(path, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(file, "record 00\n")
+	file.Close()
+
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "earlier run\n" {
+		t.Errorf("rotated file holds %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "record 00\n" {
+		t.Errorf("log file holds %q", data)
+	}
+}
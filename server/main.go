@@ -3,15 +3,33 @@ package main
 import (
 	"fmt"
 	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"go_fast_copy/metrics"
+	"go_fast_copy/networking"
 	server "go_fast_copy/server/controller"
+	"go_fast_copy/server/logging"
+	"io"
+	"log/slog"
 	"os"
 	"runtime/debug"
 	"strconv"
+	"time"
 
 	"github.com/akamensky/argparse"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		// Restore stored file instead of serving.
+		restore(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		// Show audit log instead of serving.
+		query(os.Args[1:])
+		return
+	}
+
 	args := argparse.NewParser("server", constants.Title)
 
 	chunk := args.Int("c", "chunksize", &argparse.Options{Required: false, Help: "File write chunk size in KB",
@@ -24,7 +42,29 @@ func main() {
 		Default: constants.DEFAULT_PORT})
 	queue := args.Int("q", "queue", &argparse.Options{Required: false, Help: "Write queue length",
 		Default: constants.FILE_WRITE_QUEUE})
-	path := args.String("r", "root", &argparse.Options{Required: true, Help: "Root path for storing files"})
+	path := args.String("r", "root", &argparse.Options{Required: false, Help: "Root path for storing files"})
+	stdout := args.Flag("", "stdout", &argparse.Options{Help: "Write received files to standard output instead of root path and exit once client disconnects"})
+	archiveFormat := args.Selector("", "archive", []string{"tar", "tar.zst"}, &argparse.Options{
+		Help: "Append received files to rolling tar or zstd compressed tar archives under root path instead of storing them individually"})
+	archiveSize := args.Int("", "archive-size", &argparse.Options{Help: "Start new archive once current one reaches given size in MB (0 for no limit)",
+		Default: constants.DEFAULT_ARCHIVE_SIZE})
+	archiveAge := args.String("", "archive-age", &argparse.Options{Help: "Start new archive once current one is older than given duration, e.g. 24h"})
+	restKeyFile := args.String("", "rest-key", &argparse.Options{Help: "Encrypt stored files with 256-bit key read from given file (32 bytes or 64 hex characters)"})
+	packed := args.Flag("", "pack", &argparse.Options{Help: "Store files compressed as received instead of decompressing them"})
+	bwlimit := args.String("", "bwlimit", &argparse.Options{Help: "Limit bandwidth of received files to given bytes per second, e.g. 10M. " +
+		"Comma separated rates may apply during time of day, e.g. 08:00-18:00=2M,20M"})
+	audit := args.Flag("", "audit", &argparse.Options{Help: "Record every file transfer attempt in audit log under root path"})
+	dedup := args.Flag("u", "dedup", &argparse.Options{Help: "Store files deduplicated in content-addressed chunk store"})
+	metricsAddr := args.String("", "metrics", &argparse.Options{Help: "Serve Prometheus metrics over HTTP on given address, e.g. :9100"})
+	logLevel := args.Selector("", "log-level", logging.Levels(), &argparse.Options{Help: "Only log records of given level and above",
+		Default: "info"})
+	logFormat := args.Selector("", "log-format", []string{"text", "json"}, &argparse.Options{Help: "Format of log records",
+		Default: "text"})
+	logFile := args.String("", "log-file", &argparse.Options{Help: "Write log to given file instead of standard output"})
+	logSize := args.Int("", "log-max-size", &argparse.Options{Help: "Rotate log file once it reaches given size in MB (0 for no limit)",
+		Default: constants.DEFAULT_LOG_SIZE})
+	logFiles := args.Int("", "log-max-files", &argparse.Options{Help: "Number of rotated log files to keep",
+		Default: constants.DEFAULT_LOG_FILES})
 	workers := args.Int("t", "threads", &argparse.Options{Required: false, Help: "Number of decompression (and decryption) threads",
 		Default: constants.DEFAULT_NUM_WORKERS})
 
@@ -35,16 +75,130 @@ func main() {
 		os.Exit(1)
 	}
 
+	var console io.Writer = os.Stdout
+	if *stdout {
+		// Keep standard output for received data only. Messages and log go to standard error instead.
+		console = os.Stderr
+	}
+
 	if *pass != "" {
 		if !(len(*pass) == 32) && !(len(*pass) == 16) {
-			fmt.Println("Key length must be 16 or 32 bytes")
+			fmt.Fprintln(console, "Key length must be 16 or 32 bytes")
+			os.Exit(1)
+		}
+	}
+
+	var output io.Writer
+
+	if *stdout {
+		if *dedup {
+			fmt.Fprintln(console, "Files written to standard output can't be stored deduplicated. Please do not use -u with --stdout.")
+			os.Exit(1)
+		}
+		output = os.Stdout
+	} else if *path == "" {
+		fmt.Println("Please use -r to provide root path for storing files.")
+		os.Exit(1)
+	}
+
+	var logOutput io.Writer = console
+
+	if *logFile != "" {
+		rotating, err := logging.OpenRotating(*logFile, int64(*logSize)*1024*1024, *logFiles)
+		if err != nil {
+			fmt.Fprintln(console, "Could not open log file -", err.Error())
+			os.Exit(1)
+		}
+		defer rotating.Close()
+		logOutput = rotating
+	}
+
+	slog.SetDefault(logging.New(logOutput, *logLevel, *logFormat))
+
+	if *metricsAddr != "" {
+		go func() {
+			slog.Info("Serving metrics", "address", *metricsAddr)
+			if err := metrics.Serve(*metricsAddr); err != nil {
+				slog.Error("Could not serve metrics", "address", *metricsAddr, "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	var limiter *networking.RateLimiter
+
+	if *bwlimit != "" {
+		if limiter, err = networking.NewRateLimiter(*bwlimit); err != nil {
+			fmt.Fprintln(console, "Invalid bandwidth limit:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var restKey []byte
+
+	if *restKeyFile != "" {
+		if *dedup {
+			fmt.Fprintln(console, "Chunk store can't be encrypted. Please do not use -u with --rest-key.")
+			os.Exit(1)
+		}
+		if restKey, err = fileio.LoadKey(*restKeyFile); err != nil {
+			fmt.Fprintln(console, "Could not load rest key -", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *packed && (*dedup || *stdout || *archiveFormat != "" || restKey != nil) {
+		fmt.Fprintln(console, "Please do not use -u, --stdout, --archive or --rest-key with --pack.")
+		os.Exit(1)
+	}
+
+	var archive *fileio.Archive
+
+	if *archiveFormat != "" {
+		if *dedup || *stdout {
+			fmt.Fprintln(console, "Please do not use -u or --stdout with --archive.")
+			os.Exit(1)
+		}
+		var maxAge time.Duration
+		if *archiveAge != "" {
+			if maxAge, err = time.ParseDuration(*archiveAge); err != nil || maxAge <= 0 {
+				fmt.Fprintln(console, "Invalid archive age:", *archiveAge)
+				os.Exit(1)
+			}
+		}
+		archive, err = fileio.NewArchive(*path, *archiveFormat == "tar.zst", int64(*archiveSize)*1024*1024, maxAge)
+		if err != nil {
+			fmt.Fprintln(console, "Could not open archive -", err.Error())
+			os.Exit(1)
+		}
+		defer archive.Close()
+	}
+
+	var auditLog *fileio.AuditLog
+
+	if *audit {
+		if *stdout {
+			fmt.Fprintln(console, "Audit log is kept under root path. Please do not use --audit with --stdout.")
+			os.Exit(1)
+		}
+		if auditLog, err = fileio.OpenAuditLog(*path); err != nil {
+			fmt.Fprintln(console, "Could not open audit log -", err.Error())
 			os.Exit(1)
 		}
+		defer auditLog.Close()
 	}
 
 	debug.SetGCPercent(666)
 
 	bindTo := *bind + ":" + strconv.Itoa(*port)
 
-	new(server.Server).StartListening(*pass, *path, bindTo, *chunk, *workers, *queue, *mptcp)
+	new(server.Server).StartListening(*pass, *path, bindTo, *chunk, *workers, *queue, *mptcp, &server.ServerOptions{
+		Dedup:   *dedup,
+		Output:  output,
+		Archive: archive,
+		RestKey: restKey,
+		Packed:  *packed,
+		Limiter: limiter,
+		Audit:   auditLog,
+	})
 }
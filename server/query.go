@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_fast_copy/fileio"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// query prints records of audit log matching given filters
+func query(arguments []string) {
+	args := argparse.NewParser("server query", "Show file transfers recorded in audit log")
+
+	root := args.String("r", "root", &argparse.Options{Required: true, Help: "Root path of stored files"})
+	since := args.String("", "since", &argparse.Options{Help: "Only show transfers since given time (RFC 3339 or YYYY-MM-DD) or duration ago, e.g. 24h"})
+	until := args.String("", "until", &argparse.Options{Help: "Only show transfers before given time (RFC 3339 or YYYY-MM-DD) or duration ago"})
+	client := args.String("", "client", &argparse.Options{Help: "Only show transfers from client address containing given text"})
+	identity := args.String("", "identity", &argparse.Options{Help: "Only show transfers by given identity, e.g. anonymous"})
+	name := args.String("", "name", &argparse.Options{Help: "Only show transfers of files whose path matches given pattern, e.g. logs/*.gz"})
+	result := args.Selector("", "result", []string{fileio.AuditCompleted, fileio.AuditIdentical, fileio.AuditRejected,
+		fileio.AuditMismatch, fileio.AuditFailed, fileio.AuditAborted}, &argparse.Options{Help: "Only show transfers with given result"})
+	output := args.Selector("O", "output", []string{"text", "json"}, &argparse.Options{Help: "Output format",
+		Default: "text"})
+
+	err := args.Parse(arguments)
+
+	if err != nil {
+		fmt.Print(args.Usage(err))
+		os.Exit(1)
+	}
+
+	var from, to time.Time
+	if *since != "" {
+		if from, err = parseQueryTime(*since); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	if *until != "" {
+		if to, err = parseQueryTime(*until); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *output == "text" {
+		fmt.Fprintln(table, "TIME\tRESULT\tSIZE\tDURATION\tCLIENT\tIDENTITY\tNAME")
+	}
+
+	err = fileio.ReadAuditLog(filepath.Clean(*root), func(record *fileio.AuditRecord) {
+		if !from.IsZero() && record.Time.Before(from) || !to.IsZero() && !record.Time.Before(to) ||
+			*client != "" && !strings.Contains(record.Remote, *client) ||
+			*identity != "" && record.Identity != *identity ||
+			*result != "" && record.Result != *result {
+			return
+		}
+		if *name != "" {
+			if matched, _ := path.Match(*name, filepath.ToSlash(record.Name)); !matched {
+				return
+			}
+		}
+
+		if *output == "json" {
+			encoder.Encode(record)
+		} else {
+			fmt.Fprintln(table, strings.Join([]string{
+				record.Time.Local().Format(time.DateTime),
+				record.Result,
+				strconv.FormatInt(record.Size, 10),
+				(time.Duration(record.Duration) * time.Millisecond).String(),
+				record.Remote,
+				record.Identity,
+				record.Name,
+			}, "\t"))
+		}
+	})
+	table.Flush()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read audit log -", err.Error())
+		os.Exit(1)
+	}
+}
+
+// parseQueryTime parses time in RFC 3339 or YYYY-MM-DD format, or duration before now
+func parseQueryTime(value string) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	if parsed, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return parsed, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", value)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go_fast_copy/constants"
+	"go_fast_copy/fileio"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/akamensky/argparse"
+)
+
+// restore writes original contents of file stored by server to given output
+func restore(arguments []string) {
+	args := argparse.NewParser("server restore", "Restore original contents of file stored by server")
+
+	input := args.String("i", "input", &argparse.Options{Required: true, Help: "Stored file path relative to root"})
+	output := args.String("o", "output", &argparse.Options{Required: true, Help: "Output file path (- for stdout)"})
+	path := args.String("r", "root", &argparse.Options{Required: true, Help: "Root path of stored files"})
+	restKeyFile := args.String("", "rest-key", &argparse.Options{Help: "File containing key stored files were encrypted with"})
+
+	err := args.Parse(arguments)
+
+	if err != nil {
+		fmt.Print(args.Usage(err))
+		os.Exit(1)
+	}
+
+	root := filepath.Clean(*path) + string(os.PathSeparator)
+
+	var store *fileio.ChunkStore
+	if info, err := os.Stat(root + constants.StoreDir); err == nil && info.IsDir() {
+		store, _ = fileio.NewChunkStore(root + constants.StoreDir)
+	}
+
+	var restKey []byte
+	if *restKeyFile != "" {
+		if restKey, err = fileio.LoadKey(*restKeyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var reader io.ReadCloser
+	filename := root + filepath.Clean(*input)
+	info, err := os.Stat(filename)
+	if err == nil {
+		format, _ := fileio.NewFormatIndex(root).Lookup(filename, info)
+		reader, err = fileio.OpenStored(filename, format, store, restKey)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// File may have been appended to archive instead.
+		var entry *fileio.ArchiveEntry
+		if entry, err = fileio.FindArchived(root, filepath.ToSlash(filepath.Clean(*input))); err == nil {
+			reader, err = fileio.OpenArchived(root, entry, restKey)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+
+	if _, err = io.Copy(out, reader); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
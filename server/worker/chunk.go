@@ -8,7 +8,10 @@ type decompressedChunk struct {
 
 // UnprocessedChunk could be either compressed or not
 type UnprocessedChunk struct {
-	Seq        uint32
-	Compressed bool
-	Data       []byte
+	Seq      uint32
+	Kind     uint8
+	Codec    uint16
+	Data     []byte
+	Verify   bool   // Chunk carries checksum
+	Checksum uint32 // Checksum of data as received
 }
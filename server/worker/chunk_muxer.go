@@ -1,12 +1,16 @@
 package worker
 
-import "fmt"
+import (
+	"go_fast_copy/metrics"
+	"log/slog"
+)
 
 // ChunkMuxer takes chunks in any order and reorders them for file writer
 type ChunkMuxer struct {
 	nextChunkID      uint32
 	outOfOrderChunks map[uint32]*decompressedChunk
 	maxOOC           int
+	log              *slog.Logger
 }
 
 // Start starts new goroutine for processing decompressed chunks in any order
@@ -39,9 +43,10 @@ func (c *ChunkMuxer) Start(maxBufferedOOC int, fileout chan []byte, forks int) [
 							// Received an out-of-order chunk.
 							if len(c.outOfOrderChunks) < c.maxOOC {
 								c.outOfOrderChunks[chonk.seq] = chonk
+								metrics.MuxerBuffered.Set(int64(len(c.outOfOrderChunks)))
 							} else {
-								fmt.Println("WARNING! Buffer full - dropping out-of-order chunk. " +
-									"There WILL BE data corruption!")
+								c.log.Error("Buffer full - dropping out-of-order chunk. There WILL BE data corruption!",
+									"chunk", chonk.seq)
 							}
 						}
 						// Check whether buffer contains next chunk before receiving more.
@@ -73,8 +78,11 @@ func (c *ChunkMuxer) Start(maxBufferedOOC int, fileout chan []byte, forks int) [
 			}
 		}
 
+		metrics.MuxerBuffered.Set(0)
+
 		if len(c.outOfOrderChunks) > 0 {
-			fmt.Println("WARNING! Not all chunks received - data corrupted!")
+			c.log.Error("Not all chunks received - data corrupted!", "expected", c.nextChunkID,
+				"buffered", len(c.outOfOrderChunks))
 		}
 
 		// Close file I/O channel.
@@ -89,6 +97,7 @@ func (c *ChunkMuxer) findNext() *decompressedChunk {
 	chonky := c.outOfOrderChunks[c.nextChunkID]
 	if chonky != nil {
 		delete(c.outOfOrderChunks, c.nextChunkID)
+		metrics.MuxerBuffered.Set(int64(len(c.outOfOrderChunks)))
 		c.nextChunkID = c.nextChunkID + 1
 		return chonky
 	}
@@ -1,9 +1,17 @@
 package worker
 
 import (
+	"errors"
+	"fmt"
 	"go_fast_copy/constants"
 	"go_fast_copy/fileio"
+	"go_fast_copy/metrics"
 	"go_fast_copy/networking"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
 )
 
 // ChunkProcessor is responsible for starting workers and passing work
@@ -13,23 +21,81 @@ type ChunkProcessor struct {
 	next        int
 	mux         *ChunkMuxer
 	fioComplete chan []byte
+	queue       chan []byte // Write queue of file writer
+	basis       *os.File
+	store       *fileio.ChunkStore
+	packed      bool // Chunks are passed on as frames of packed file instead of decompressing them
+	digest      bool // Writer calculates checksum of original contents
+	pending     sync.WaitGroup
+	badLock     sync.Mutex
+	bad         map[uint32]bool // Chunks waiting to be sent again
+	failure     error           // First chunk which could not be processed
+	nack        func(seq uint32)
 }
 
 // NewFile prepares file writer
-func (s *ChunkProcessor) NewFile(factory fileio.IOFactory, filename string, bufferSize, qlen int, sha bool) {
+func (s *ChunkProcessor) NewFile(factory fileio.IOFactory, filename string, bufferSize, qlen int, algorithm uint8) {
 	s.writer = factory.NewWriter()
-	if err := s.writer.New(filename, bufferSize, qlen, sha); err != nil {
+	if err := s.writer.New(filename, bufferSize, qlen, algorithm); err != nil {
 		panic(err)
 	}
-	s.mux = new(ChunkMuxer)
+	s.mux = &ChunkMuxer{log: slog.Default()}
+	s.bad = make(map[uint32]bool)
+	s.digest = fileio.HashName(algorithm) != "none"
+}
+
+// UseTree makes writer build hash tree over blocks of given size
+func (s *ChunkProcessor) UseTree(blockSize int) {
+	s.writer.UseTree(blockSize)
+	s.digest = true
+}
+
+// Size returns size of original contents written once file has been written
+func (s *ChunkProcessor) Size() int64 {
+	return s.writer.Size()
+}
+
+// Tree returns hash tree built by writer once file has been written
+func (s *ChunkProcessor) Tree() *fileio.MerkleTree {
+	return s.writer.Tree()
+}
+
+// UseLogger sets logger warnings about chunks of file are written to
+func (s *ChunkProcessor) UseLogger(log *slog.Logger) {
+	s.mux.log = log
+}
+
+// UseNack sets function called with sequence number of every chunk which fails verification
+func (s *ChunkProcessor) UseNack(nack func(seq uint32)) {
+	s.nack = nack
+}
+
+// UseBasis opens existing file which copy chunks refer to
+func (s *ChunkProcessor) UseBasis(filename string) {
+	basis, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	s.basis = basis
+}
+
+// UseStore makes workers persist chunks in chunk store and write manifest entries instead of data
+func (s *ChunkProcessor) UseStore(store *fileio.ChunkStore) {
+	s.store = store
+}
+
+// UsePacking makes workers pass chunks on as frames of packed file without decompressing them
+func (s *ChunkProcessor) UsePacking() {
+	s.packed = true
 }
 
 // StartForks starts workers for processing chunks
-func (s *ChunkProcessor) StartForks(forkCount int, crypto *networking.Crypto) {
+func (s *ChunkProcessor) StartForks(forkCount int, crypto *networking.Crypto, dictionary []byte) {
 	chunkProcessingQueues := make([]chan *UnprocessedChunk, 0, forkCount)
 	// Start file writing.
 	outChan, fioc := s.writer.StartWriting()
 	s.fioComplete = fioc
+	s.queue = outChan
 	// Start chunk muxer.
 	dcStreams := s.mux.Start(constants.MAX_OOC, outChan, forkCount)
 
@@ -39,41 +105,198 @@ func (s *ChunkProcessor) StartForks(forkCount int, crypto *networking.Crypto) {
 		chunkProcessingQueues = append(chunkProcessingQueues, workerChunkProcQ)
 		decompChannel := dcStreams[i]
 
-		go func(in chan *UnprocessedChunk, out chan *decompressedChunk, crypto *networking.Crypto) {
+		go func(in chan *UnprocessedChunk, out chan *decompressedChunk, crypto *networking.Crypto, index int) {
+			timer := metrics.Decompression(index)
 			for {
 				com, open := <-in
 				if com == nil || !open {
 					break
 				}
 
+				if !s.verify(com) {
+					// Ask client to send chunk again.
+					s.nack(com.Seq)
+					s.pending.Done()
+					continue
+				}
+
 				// Decrypt the chunk first if encrypted.
 				com.Data = crypto.Decrypt(com.Data)
 
-				// Decompress if compressed.
-				if com.Compressed {
-					out <- &decompressedChunk{
-						seq: com.Seq,
-						raw: fileio.DecompressChunk(com.Data),
-					}
-				} else {
-					// Chunk was not compressed so no action required.
-					out <- &decompressedChunk{
-						seq: com.Seq,
-						raw: com.Data,
+				var raw []byte
+				var err error
+
+				switch com.Kind {
+				case constants.CHUNK_COPY:
+					// Chunk refers to data in existing file.
+					raw, err = s.copyFromBasis(com.Data)
+				case constants.CHUNK_REFERENCE:
+					// Chunk refers to data already in chunk store.
+					raw, err = s.referenceInStore(com.Data)
+				default:
+					start := time.Now()
+					if s.packed {
+						// Store chunk compressed as it was received.
+						raw, err = pack(com, dictionary)
+						if err == nil && s.digest {
+							// Writer only has to hash original data, which is unpacked here in parallel.
+							var original []byte
+							if original, err = fileio.UnpackChunk(raw); err == nil {
+								raw = fileio.AppendOriginal(raw, original)
+							}
+						}
+						timer.Observe(time.Since(start))
+						if err == nil {
+							metrics.ReceivedRaw.Add(uint64(fileio.PackedLength(raw)))
+						}
+					} else {
+						raw, err = decompress(com, dictionary)
+						timer.Observe(time.Since(start))
+						metrics.ReceivedRaw.Add(uint64(len(raw)))
+						if err == nil && s.store != nil {
+							// Persist chunk in store and only pass on its manifest entry.
+							raw, err = s.putInStore(raw)
+						}
 					}
 				}
+
+				if err != nil {
+					// Controller ends transfer once it learns chunk could not be processed.
+					s.fail(com.Seq, err)
+					s.pending.Done()
+					continue
+				}
+
+				out <- &decompressedChunk{
+					seq: com.Seq,
+					raw: raw,
+				}
+				s.pending.Done()
 			}
 			close(decompChannel)
-		}(workerChunkProcQ, decompChannel, crypto)
+		}(workerChunkProcQ, decompChannel, crypto, i)
 	}
 
 	s.forks = chunkProcessingQueues
 }
 
-// ProcessNextChunk passes chunk to next worker
-func (s *ChunkProcessor) ProcessNextChunk(chunk *UnprocessedChunk) {
+// verify checks chunk checksum if it carries one and keeps track of chunks which failed verification
+func (s *ChunkProcessor) verify(com *UnprocessedChunk) bool {
+	valid := !com.Verify || networking.ChunkChecksum(com.Data) == com.Checksum
+	s.badLock.Lock()
+	defer s.badLock.Unlock()
+	if valid {
+		delete(s.bad, com.Seq)
+	} else {
+		s.bad[com.Seq] = true
+	}
+	return valid
+}
+
+// fail records error of chunk which could not be processed. Only first error is kept.
+func (s *ChunkProcessor) fail(seq uint32, err error) {
+	s.badLock.Lock()
+	defer s.badLock.Unlock()
+	if s.failure == nil {
+		s.failure = fmt.Errorf("chunk %d: %w", seq, err)
+	}
+}
+
+// decompress returns raw data of chunk
+func decompress(com *UnprocessedChunk, dictionary []byte) ([]byte, error) {
+	switch com.Codec {
+	case constants.CODEC_LZ4:
+		return fileio.DecompressChunk(com.Data, nil)
+	case constants.CODEC_LZ4_DICT:
+		if dictionary == nil {
+			return nil, errors.New("protocol error: client sent chunk compressed with dictionary it never announced")
+		}
+		return fileio.DecompressChunk(com.Data, dictionary)
+	case constants.CODEC_NONE:
+		// Chunk was not compressed so no action required.
+		return com.Data, nil
+	default:
+		return nil, fmt.Errorf("protocol error: client sent chunk with unknown codec %d", com.Codec)
+	}
+}
+
+// pack returns chunk as frame of packed file
+func pack(com *UnprocessedChunk, dictionary []byte) ([]byte, error) {
+	frame, err := fileio.PackChunk(com.Data, com.Codec, dictionary)
+	if err != nil {
+		return nil, errors.New("protocol error: client sent chunk which can't be stored packed - " + err.Error())
+	}
+	return frame, nil
+}
+
+// putInStore stores chunk in chunk store and returns its encoded manifest entry
+func (s *ChunkProcessor) putInStore(raw []byte) ([]byte, error) {
+	entry, err := s.store.Put(raw)
+	if err != nil {
+		return nil, err
+	}
+	return fileio.EncodeEntry(entry), nil
+}
+
+// referenceInStore checks chunk referred to exists in chunk store and returns its encoded manifest entry
+func (s *ChunkProcessor) referenceInStore(data []byte) ([]byte, error) {
+	var reference networking.ChunkReference
+	if s.store == nil || networking.DecodePayload(data, &reference, nil) != nil {
+		return nil, errors.New("protocol error: client sent invalid chunk reference")
+	}
+	entry := fileio.ManifestEntry{Hash: reference.Hash, Length: reference.Length}
+	if !s.store.Has(entry.Hash) {
+		return nil, errors.New("protocol error: client referred to chunk which is not in store")
+	}
+	return fileio.EncodeEntry(entry), nil
+}
+
+// copyFromBasis reads range of existing file described by copy chunk
+func (s *ChunkProcessor) copyFromBasis(data []byte) ([]byte, error) {
+	var instruction networking.BlockCopy
+	if s.basis == nil || networking.DecodePayload(data, &instruction, nil) != nil ||
+		instruction.Length > constants.MAX_CLIENT_CHUNK_SIZE*1024 {
+		return nil, errors.New("protocol error: client sent invalid copy instruction")
+	}
+	raw := make([]byte, instruction.Length)
+	read, err := s.basis.ReadAt(raw, int64(instruction.Offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if read < len(raw) {
+		return nil, errors.New("protocol error: client sent copy instruction beyond end of existing file")
+	}
+	return raw, nil
+}
+
+// ProcessNextChunk passes chunk to next worker. Error is returned instead once any chunk passed so far could not be
+// processed.
+func (s *ChunkProcessor) ProcessNextChunk(chunk *UnprocessedChunk) error {
+	s.badLock.Lock()
+	failure := s.failure
+	s.badLock.Unlock()
+	if failure != nil {
+		return failure
+	}
+
+	s.pending.Add(1)
 	s.forks[s.next] <- chunk
 	s.next = (s.next + 1) % len(s.forks)
+	return nil
+}
+
+// Queued returns number of chunks waiting in write queue of file writer
+func (s *ChunkProcessor) Queued() int {
+	return len(s.queue)
+}
+
+// Drain waits for all chunks passed so far to be processed and returns number of chunks waiting to be sent again.
+// Error is returned if any chunk could not be processed.
+func (s *ChunkProcessor) Drain() (int, error) {
+	s.pending.Wait()
+	s.badLock.Lock()
+	defer s.badLock.Unlock()
+	return len(s.bad), s.failure
 }
 
 // Stop ends all forks
@@ -82,5 +305,10 @@ func (s *ChunkProcessor) Stop() []byte {
 		close(fork)
 	}
 	// Wait for all data to be persisted.
-	return <-s.fioComplete
+	hash := <-s.fioComplete
+	if s.basis != nil {
+		s.basis.Close()
+		s.basis = nil
+	}
+	return hash
 }